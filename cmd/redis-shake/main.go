@@ -3,6 +3,7 @@ package main
 import (
 	"RedisShake/internal/config"
 	"RedisShake/internal/function"
+	"RedisShake/internal/guard"
 	"RedisShake/internal/log"
 	"RedisShake/internal/reader"
 	"RedisShake/internal/status"
@@ -15,11 +16,13 @@ import (
 func main() {
 	v := config.LoadConfig()
 
-	log.Init(config.Opt.Advanced.LogLevel, config.Opt.Advanced.LogFile, config.Opt.Advanced.Dir)
+	log.Init(config.Opt.Advanced.LogLevel, config.Opt.Advanced.LogFile, config.Opt.Advanced.Dir,
+		config.Opt.Advanced.DeadLetterFile, config.Opt.Guard.QuarantineFile)
 	utils.ChdirAndAcquireFileLock()
 	utils.SetNcpu()
 	utils.SetPprofPort()
 	function.Init()
+	guard.Init()
 
 	// create reader
 	var theReader reader.Reader
@@ -44,6 +47,7 @@ func main() {
 		if err != nil {
 			log.Panicf("failed to read the ScanReader config entry. err: %v", err)
 		}
+		opts.KeysPrefixed = v.GetBool("redis_writer.fold_db")
 		if opts.Cluster {
 			theReader = reader.NewScanClusterReader(opts)
 			log.Infof("create ScanClusterReader: %v", opts.Address)
@@ -69,6 +73,16 @@ func main() {
 		}
 		theReader = reader.NewAOFReader(opts)
 		log.Infof("create AOFReader: %v", opts.Filepath)
+	} else if v.IsSet("merge_reader") {
+		opts := new(reader.MergeReaderOptions)
+		defaults.SetDefaults(opts)
+		err := v.UnmarshalKey("merge_reader", opts)
+		if err != nil {
+			log.Panicf("failed to read the MergeReader config entry. err: %v", err)
+		}
+		opts.KeysPrefixed = v.GetBool("redis_writer.fold_db")
+		theReader = reader.NewMergeReader(opts)
+		log.Infof("create MergeReader: %d sources", len(opts.Sources))
 	} else {
 		log.Panicf("no reader config entry found")
 	}
@@ -100,8 +114,16 @@ func main() {
 
 	ch := theReader.StartRead()
 	for e := range ch {
-		// calc arguments
-		e.Parse()
+		if e.Checkpoint != nil {
+			theWriter.Flush()
+			e.Checkpoint()
+			continue
+		}
+
+		// calc arguments, unless parsed by the reader
+		if e.CmdName == "" {
+			e.Parse()
+		}
 		status.AddReadCount(e.CmdName)
 
 		// filter
@@ -111,6 +133,9 @@ func main() {
 
 		for _, entry := range entries {
 			entry.Parse()
+			if !guard.Check(entry) {
+				continue
+			}
 			theWriter.Write(entry)
 			status.AddWriteCount(entry.CmdName)
 		}
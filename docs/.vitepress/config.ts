@@ -34,6 +34,7 @@ export default defineConfig({
                             { text: 'Sync Reader', link: '/zh/reader/sync_reader' },
                             { text: 'Scan Reader', link: '/zh/reader/scan_reader' },
                             { text: 'RDB Reader', link: '/zh/reader/rdb_reader' },
+                            { text: 'Merge Reader', link: '/zh/reader/merge_reader' },
                         ]
                     },
                     {
@@ -88,6 +89,7 @@ export default defineConfig({
                             { text: 'Sync Reader', link: '/en/reader/sync_reader' },
                             { text: 'Scan Reader', link: '/en/reader/scan_reader' },
                             { text: 'RDB Reader', link: '/en/reader/rdb_reader' },
+                            { text: 'Merge Reader', link: '/en/reader/merge_reader' },
                         ]
                     },
                     {
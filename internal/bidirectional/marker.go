@@ -0,0 +1,44 @@
+package bidirectional
+
+import (
+	"RedisShake/internal/config"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Channel is the channel of the marker PUBLISH sent by the writer in the same
+// transaction as every command, so that the sync reader on the other side can
+// tell the commands written by redis-shake from the ones written by clients.
+const Channel = "__redis_shake__"
+
+func Enabled() bool {
+	return config.Opt.Bidirectional.Enable
+}
+
+// Marker returns the marker message of this instance, "<id>:<priority>".
+func Marker() string {
+	return fmt.Sprintf("%s:%d", config.Opt.Bidirectional.Id, config.Opt.Bidirectional.Priority)
+}
+
+// MarkerArgv returns the marker PUBLISH command of this instance.
+func MarkerArgv() []string {
+	return []string{"PUBLISH", Channel, Marker()}
+}
+
+// ParseMarker returns the id and priority of the instance that sent the
+// command, ok is false if argv is not a marker PUBLISH.
+func ParseMarker(argv []string) (id string, priority int, ok bool) {
+	if len(argv) != 3 || !strings.EqualFold(argv[0], "PUBLISH") || argv[1] != Channel {
+		return "", 0, false
+	}
+	i := strings.LastIndex(argv[2], ":")
+	if i < 0 {
+		return argv[2], 0, true
+	}
+	priority, err := strconv.Atoi(argv[2][i+1:])
+	if err != nil {
+		return argv[2], 0, true
+	}
+	return argv[2][:i], priority, true
+}
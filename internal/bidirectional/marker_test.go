@@ -0,0 +1,24 @@
+package bidirectional
+
+import "testing"
+
+func TestParseMarker(t *testing.T) {
+	cases := []struct {
+		argv     []string
+		id       string
+		priority int
+		ok       bool
+	}{
+		{[]string{"PUBLISH", Channel, "shake-a:2"}, "shake-a", 2, true},
+		{[]string{"publish", Channel, "a:b:-1"}, "a:b", -1, true},
+		{[]string{"PUBLISH", Channel, "shake-a"}, "shake-a", 0, true},
+		{[]string{"PUBLISH", "other", "shake-a:2"}, "", 0, false},
+		{[]string{"SET", Channel, "shake-a:2"}, "", 0, false},
+	}
+	for _, c := range cases {
+		id, priority, ok := ParseMarker(c.argv)
+		if id != c.id || priority != c.priority || ok != c.ok {
+			t.Errorf("ParseMarker(%v) = %s, %d, %v, want %s, %d, %v", c.argv, id, priority, ok, c.id, c.priority, c.ok)
+		}
+	}
+}
@@ -25,3 +25,24 @@ func (r *Redis) IsCluster() bool {
 	reply := r.DoWithStringReply("INFO", "Cluster")
 	return strings.Contains(reply, "cluster_enabled:1")
 }
+
+// ServerVersion returns redis_version in INFO server, e.g. "6.2.7".
+// Returns an empty string if the server does not report it.
+func (r *Redis) ServerVersion() string {
+	r.Send("INFO", "server")
+	reply, err := r.Receive()
+	if err != nil {
+		log.Warnf("get server version failed. err=[%v]", err)
+		return ""
+	}
+	info, ok := reply.(string)
+	if !ok {
+		return ""
+	}
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, "redis_version:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "redis_version:"))
+		}
+	}
+	return ""
+}
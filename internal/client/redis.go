@@ -2,22 +2,51 @@ package client
 
 import (
 	"RedisShake/internal/client/proto"
+	"RedisShake/internal/config"
 	"RedisShake/internal/log"
 	"bufio"
 	"crypto/tls"
+	"fmt"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Redis struct {
+	conn        net.Conn
 	reader      *bufio.Reader
 	writer      *bufio.Writer
 	protoReader *proto.Reader
 	protoWriter *proto.Writer
+
+	protocol   int  // RESP version, 2 or 3
+	subscribed bool // push messages are replies of a subscribed connection
 }
 
+// NewRedisClient creates a client that speaks RESP2.
 func NewRedisClient(address string, username string, password string, Tls bool) *Redis {
+	return NewRedisClientWithProtocol(address, username, password, Tls, 2)
+}
+
+// NewRedisClientWithProtocol creates a client that speaks RESP2 or RESP3.
+// RESP3 is negotiated with HELLO, which authenticates and sets the client
+// name in the same round trip and requires Redis 6.0+.
+func NewRedisClientWithProtocol(address string, username string, password string, Tls bool, protocol int) *Redis {
+	r, err := DialRedisClient(address, username, password, Tls, protocol)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	return r
+}
+
+// DialRedisClient is like NewRedisClientWithProtocol, but returns the error
+// instead of exiting if the source can not be connected, e.g. while it is
+// restarting, so that the caller can try again.
+func DialRedisClient(address string, username string, password string, Tls bool, protocol int) (*Redis, error) {
+	if protocol != 2 && protocol != 3 {
+		log.Panicf("invalid protocol, only 2 and 3 are supported. protocol=[%d]", protocol)
+	}
 	r := new(Redis)
 	var conn net.Conn
 	var dialer net.Dialer
@@ -29,34 +58,79 @@ func NewRedisClient(address string, username string, password string, Tls bool)
 		conn, err = dialer.Dial("tcp", address)
 	}
 	if err != nil {
-		log.Panicf("dial failed. address=[%s], tls=[%v], err=[%v]", address, Tls, err)
+		return nil, fmt.Errorf("dial failed. address=[%s], tls=[%v], err=[%v]", address, Tls, err)
 	}
 
+	r.conn = conn
 	r.reader = bufio.NewReader(conn)
 	r.writer = bufio.NewWriter(conn)
 	r.protoReader = proto.NewReader(r.reader)
 	r.protoWriter = proto.NewWriter(r.writer)
+	r.protocol = protocol
 
-	// auth
-	if password != "" {
-		var reply string
-		if username != "" {
-			reply = r.DoWithStringReply("auth", username, password)
-		} else {
-			reply = r.DoWithStringReply("auth", password)
-		}
-		if reply != "OK" {
-			log.Panicf("auth failed with reply: %s", reply)
+	clientName := config.Opt.Advanced.ClientName
+	if protocol == 3 {
+		err = r.hello(address, username, password, clientName)
+	} else if err = r.auth(username, password); err == nil {
+		r.setName(address, clientName)
+	}
+	if err == nil {
+		// ping to test connection
+		var reply interface{}
+		if reply, err = r.TryDo("ping"); err == nil && reply != "PONG" {
+			err = fmt.Errorf("ping failed with reply: %v", reply)
 		}
 	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Redis) auth(username string, password string) error {
+	if password == "" {
+		return nil
+	}
+	var reply interface{}
+	var err error
+	if username != "" {
+		reply, err = r.TryDo("auth", username, password)
+	} else {
+		reply, err = r.TryDo("auth", password)
+	}
+	if err != nil || reply != "OK" {
+		return fmt.Errorf("auth failed with reply: %v, err=[%v]", reply, err)
+	}
+	return nil
+}
 
-	// ping to test connection
-	reply := r.DoWithStringReply("ping")
-	if reply != "PONG" {
-		panic("ping failed with reply: " + reply)
+// setName sets the client name shown in CLIENT LIST. Some proxies do not
+// support CLIENT SETNAME, so a failure is not fatal.
+func (r *Redis) setName(address string, clientName string) {
+	if clientName == "" {
+		return
 	}
+	if _, err := r.TryDo("client", "setname", clientName); err != nil {
+		log.Warnf("set client name failed. address=[%s], client_name=[%s], err=[%v]", address, clientName, err)
+	}
+}
 
-	return r
+func (r *Redis) hello(address string, username string, password string, clientName string) error {
+	args := []string{"hello", "3"}
+	if password != "" {
+		if username == "" {
+			username = "default"
+		}
+		args = append(args, "auth", username, password)
+	}
+	if clientName != "" {
+		args = append(args, "setname", clientName)
+	}
+	if _, err := r.TryDo(args...); err != nil {
+		return fmt.Errorf("negotiate RESP3 failed, HELLO requires Redis 6.0+. address=[%s], err=[%v]", address, err)
+	}
+	return nil
 }
 
 func (r *Redis) DoWithStringReply(args ...string) string {
@@ -81,15 +155,32 @@ func (r *Redis) Do(args ...string) interface{} {
 }
 
 func (r *Redis) Send(args ...string) {
+	if err := r.TrySend(args...); err != nil {
+		log.Panicf(err.Error())
+	}
+}
+
+// TrySend is like Send, but returns the error instead of exiting.
+func (r *Redis) TrySend(args ...string) error {
+	if len(args) > 0 && strings.HasSuffix(strings.ToLower(args[0]), "subscribe") {
+		r.subscribed = true
+	}
 	argsInterface := make([]interface{}, len(args))
 	for inx, item := range args {
 		argsInterface[inx] = item
 	}
-	err := r.protoWriter.WriteArgs(argsInterface)
-	if err != nil {
-		log.Panicf(err.Error())
+	if err := r.protoWriter.WriteArgs(argsInterface); err != nil {
+		return err
 	}
-	r.flush()
+	return r.writer.Flush()
+}
+
+// TryDo is like Do, but returns the error instead of exiting.
+func (r *Redis) TryDo(args ...string) (interface{}, error) {
+	if err := r.TrySend(args...); err != nil {
+		return nil, err
+	}
+	return r.Receive()
 }
 
 func (r *Redis) SendBytes(buf []byte) {
@@ -107,7 +198,26 @@ func (r *Redis) flush() {
 	}
 }
 
+func (r *Redis) Close() {
+	if err := r.conn.Close(); err != nil {
+		log.Warnf("close connection failed. err=[%v]", err)
+	}
+}
+
 func (r *Redis) Receive() (interface{}, error) {
+	// RESP3 push messages are out of band unless the connection is subscribed,
+	// skip them to keep the replies in order with the commands.
+	for r.protocol == 3 && !r.subscribed {
+		t, err := r.protoReader.PeekReplyType()
+		if err != nil || t != proto.RespPush {
+			break
+		}
+		reply, err := r.protoReader.ReadReply()
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("skip push message. reply=[%v]", reply)
+	}
 	return r.protoReader.ReadReply()
 }
 
@@ -130,8 +240,17 @@ func (r *Redis) SetBufioReader(rd *bufio.Reader) {
 
 /* Commands */
 
-func (r *Redis) Scan(cursor uint64) (newCursor uint64, keys []string) {
-	r.Send("scan", strconv.FormatUint(cursor, 10), "count", "2048")
+// Scan returns the keys of the next SCAN iteration. match and typ are the
+// MATCH and TYPE options, omitted if empty. TYPE requires Redis 6.0+.
+func (r *Redis) Scan(cursor uint64, match string, count int, typ string) (newCursor uint64, keys []string) {
+	args := []string{"scan", strconv.FormatUint(cursor, 10), "count", strconv.Itoa(count)}
+	if match != "" {
+		args = append(args, "match", match)
+	}
+	if typ != "" {
+		args = append(args, "type", typ)
+	}
+	r.Send(args...)
 	reply, err := r.Receive()
 	if err != nil {
 		log.Panicf(err.Error())
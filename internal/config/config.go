@@ -36,7 +36,15 @@ type AdvancedOptions struct {
 	TargetRedisClientMaxQuerybufLen int64  `mapstructure:"target_redis_client_max_querybuf_len" default:"1024000000"`
 	TargetRedisProtoMaxBulkLen      uint64 `mapstructure:"target_redis_proto_max_bulk_len" default:"512000000"`
 
+	// Name of every connection to the source and the target, shown in CLIENT
+	// LIST. Keep empty to not set the name.
+	ClientName string `mapstructure:"client_name" default:"redis-shake"`
+
 	AwsPSync string `mapstructure:"aws_psync" default:""` // 10.0.0.1:6379@nmfu2sl5osync,10.0.0.1:6379@xhma21xfkssync
+
+	// Entries that can not be written to the target are appended to this file
+	// in AOF format when the corresponding behavior is set to dead_letter.
+	DeadLetterFile string `mapstructure:"dead_letter_file" default:"dead_letter.aof"`
 }
 
 type ModuleOptions struct {
@@ -54,10 +62,44 @@ func (opt *AdvancedOptions) GetPSyncCommand(address string) string {
 	return ""
 }
 
+type GuardOptions struct {
+	// Destructive commands to guard, e.g. ["FLUSHALL", "FLUSHDB", "SWAPDB"].
+	Commands []string `mapstructure:"commands"`
+	// DEL and UNLINK are guarded when more keys than this are deleted in a
+	// second. 0 means no limit.
+	MaxDeletedKeysPerSecond int `mapstructure:"max_deleted_keys_per_second" default:"0"`
+	// What to do with the guarded commands:
+	// log:     redis-shake will log the command and write it to the target.
+	// block:   redis-shake will not write the command but append it to quarantine_file.
+	// confirm: redis-shake will stop syncing until the command is confirmed or
+	//          rejected through the status port, rejected commands are appended
+	//          to quarantine_file.
+	Action         string `mapstructure:"action" default:"log"`
+	ConfirmTimeout int    `mapstructure:"confirm_timeout" default:"0"` // in seconds, reject the command on timeout, 0 means wait forever
+	QuarantineFile string `mapstructure:"quarantine_file" default:"quarantine.aof"`
+}
+
+type BidirectionalOptions struct {
+	Enable bool `mapstructure:"enable" default:"false"`
+	// Id of this redis-shake instance, written to the target with every command.
+	Id string `mapstructure:"id" default:"redis-shake"`
+	// Priority of the source of this instance. When the same key is written on
+	// both sides within conflict_window, the write from the side with the higher
+	// priority wins.
+	Priority int `mapstructure:"priority" default:"0"`
+	// Milliseconds to hold the writes of the source before sending them to the
+	// target, to find out conflicts with the writes from a higher priority side.
+	// 0 means no conflict resolution.
+	ConflictWindow int `mapstructure:"conflict_window" default:"0"`
+}
+
 type ShakeOptions struct {
 	Function string `mapstructure:"function" default:""`
 	Advanced AdvancedOptions
 	Module   ModuleOptions
+	Guard    GuardOptions
+
+	Bidirectional BidirectionalOptions
 }
 
 var Opt ShakeOptions
@@ -0,0 +1,92 @@
+package deadletter
+
+import (
+	"RedisShake/internal/config"
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Behaviors for entries that can not be written to the target as they are.
+// panic:       redis-shake will stop.
+// skip:        redis-shake will log the entry and skip it.
+// dead_letter: redis-shake will append the entry to the dead letter file.
+const (
+	BehaviorPanic      = "panic"
+	BehaviorSkip       = "skip"
+	BehaviorDeadLetter = "dead_letter"
+)
+
+// Writer appends entries to a file in AOF format, so that they can be
+// replayed manually later, e.g. `redis-cli --pipe < dead_letter.aof`.
+type Writer struct {
+	path string
+	file *os.File
+	dbId int
+	lock sync.Mutex
+}
+
+func NewWriter(path string) *Writer {
+	w := new(Writer)
+	w.path = path
+	w.dbId = -1
+	return w
+}
+
+func (w *Writer) Write(e *entry.Entry) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		var err error
+		w.file, err = os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Panicf("open file failed. file=[%s], err=[%v]", w.path, err)
+		}
+		log.Infof("open file for write. filename=[%s]", w.path)
+	}
+	if w.dbId != e.DbId {
+		selectEntry := &entry.Entry{Argv: []string{"select", strconv.Itoa(e.DbId)}}
+		w.write(selectEntry.Serialize())
+		w.dbId = e.DbId
+	}
+	w.write(e.Serialize())
+}
+
+func (w *Writer) write(buf []byte) {
+	_, err := w.file.Write(buf)
+	if err != nil {
+		log.Panicf("write file failed. file=[%s], err=[%v]", w.path, err)
+	}
+}
+
+var defaultWriter *Writer
+var defaultWriterOnce sync.Once
+
+// CheckBehavior panics if behavior is not one of panic, skip or dead_letter.
+func CheckBehavior(name string, behavior string) {
+	switch behavior {
+	case BehaviorPanic, BehaviorSkip, BehaviorDeadLetter:
+	default:
+		log.Panicf("invalid %s: [%s], must be one of panic, skip or dead_letter", name, behavior)
+	}
+}
+
+// Reject handles an entry that can not be written to the target according to behavior.
+func Reject(behavior string, e *entry.Entry, reason string) {
+	switch behavior {
+	case BehaviorPanic:
+		log.Panicf("%s. cmd=[%s]", reason, e.String())
+	case BehaviorSkip:
+		log.Warnf("%s, skip it. cmd=[%s]", reason, e.String())
+	case BehaviorDeadLetter:
+		defaultWriterOnce.Do(func() {
+			defaultWriter = NewWriter(config.Opt.Advanced.DeadLetterFile)
+		})
+		log.Warnf("%s, write it to dead letter file [%s]. cmd=[%s]", reason, defaultWriter.path, e.String())
+		defaultWriter.Write(e)
+	default:
+		log.Panicf("unknown behavior [%s]. %s. cmd=[%s]", behavior, reason, e.String())
+	}
+}
@@ -20,6 +20,11 @@ type Entry struct {
 
 	// for stat
 	SerializedSize int64
+
+	// Checkpoint is set on the entries without Argv that mark a position of the
+	// reader. It is called after all the entries before it are written to the
+	// target.
+	Checkpoint func()
 }
 
 func NewEntry() *Entry {
@@ -55,3 +60,12 @@ func (e *Entry) Parse() {
 	e.CmdName, e.Group, e.Keys, e.KeyIndexes = commands.CalcKeys(e.Argv)
 	e.Slots = commands.CalcSlots(e.Keys)
 }
+
+// AddKeyPrefix prepends prefix to every key of the entry and recalculates the
+// keys and slots. The hash tag of a key is kept as long as prefix contains no '{'.
+func (e *Entry) AddKeyPrefix(prefix string) {
+	for _, keyIndex := range e.KeyIndexes {
+		e.Argv[keyIndex-1] = prefix + e.Argv[keyIndex-1]
+	}
+	e.Parse()
+}
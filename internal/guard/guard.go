@@ -0,0 +1,184 @@
+package guard
+
+import (
+	"RedisShake/internal/config"
+	"RedisShake/internal/deadletter"
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"RedisShake/internal/status"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ActionLog     = "log"
+	ActionBlock   = "block"
+	ActionConfirm = "confirm"
+)
+
+var opts *config.GuardOptions
+var enabled bool
+var commands = make(map[string]bool)
+var quarantine *deadletter.Writer
+
+// DEL and UNLINK in the current second
+var deleteSecond int64
+var deletedKeys int
+
+// the command waiting for confirmation
+var lock sync.Mutex
+var pending *entry.Entry
+var decision chan bool
+
+var stat struct {
+	Pending          string `json:"pending"`
+	PendingReason    string `json:"pending_reason"`
+	GuardedCount     int64  `json:"guarded_count"`
+	QuarantinedCount int64  `json:"quarantined_count"`
+}
+
+func Init() {
+	opts = &config.Opt.Guard
+	for _, cmd := range opts.Commands {
+		commands[strings.ReplaceAll(strings.ToUpper(strings.TrimSpace(cmd)), " ", "-")] = true
+	}
+	enabled = len(commands) != 0 || opts.MaxDeletedKeysPerSecond > 0
+	if !enabled {
+		log.Infof("no guard")
+		return
+	}
+	switch opts.Action {
+	case ActionLog, ActionBlock:
+	case ActionConfirm:
+		if config.Opt.Advanced.StatusPort == 0 {
+			log.Panicf("guard action confirm requires status_port")
+		}
+	default:
+		log.Panicf("invalid guard action: [%s], must be one of log, block or confirm", opts.Action)
+	}
+	quarantine = deadletter.NewWriter(opts.QuarantineFile)
+	status.RegisterHandler("/guard", statusHandler)
+	status.RegisterHandler("/guard/confirm", decisionHandler(true))
+	status.RegisterHandler("/guard/reject", decisionHandler(false))
+	log.Infof("guard commands=%v, max_deleted_keys_per_second=[%d], action=[%s]", opts.Commands, opts.MaxDeletedKeysPerSecond, opts.Action)
+}
+
+// Check returns false if the entry should not be written to the target. It
+// blocks until the entry is confirmed or rejected when action is confirm.
+func Check(e *entry.Entry) bool {
+	if !enabled {
+		return true
+	}
+	reason := match(e)
+	if reason == "" {
+		return true
+	}
+	lock.Lock()
+	stat.GuardedCount++
+	lock.Unlock()
+	switch opts.Action {
+	case ActionBlock:
+		quarantineEntry(e, reason)
+		return false
+	case ActionConfirm:
+		return waitConfirm(e, reason)
+	default:
+		log.Warnf("[guard] %s, write it to target. cmd=[%s]", reason, e.String())
+		return true
+	}
+}
+
+func match(e *entry.Entry) string {
+	if commands[e.CmdName] {
+		return fmt.Sprintf("%s is a guarded command", e.CmdName)
+	}
+	if opts.MaxDeletedKeysPerSecond > 0 && (e.CmdName == "DEL" || e.CmdName == "UNLINK") {
+		now := time.Now().Unix()
+		if now != deleteSecond {
+			deleteSecond = now
+			deletedKeys = 0
+		}
+		deletedKeys += len(e.Keys)
+		if deletedKeys > opts.MaxDeletedKeysPerSecond {
+			return fmt.Sprintf("deleted more than %d keys per second", opts.MaxDeletedKeysPerSecond)
+		}
+	}
+	return ""
+}
+
+func quarantineEntry(e *entry.Entry, reason string) {
+	log.Warnf("[guard] %s, write it to quarantine file [%s]. cmd=[%s]", reason, opts.QuarantineFile, e.String())
+	quarantine.Write(e)
+	lock.Lock()
+	stat.QuarantinedCount++
+	lock.Unlock()
+}
+
+func waitConfirm(e *entry.Entry, reason string) bool {
+	ch := make(chan bool, 1)
+	lock.Lock()
+	pending, decision = e, ch
+	stat.Pending, stat.PendingReason = e.String(), reason
+	lock.Unlock()
+	log.Warnf("[guard] %s, syncing is paused. cmd=[%s]", reason, e.String())
+	log.Warnf("[guard] confirm: curl -X POST http://localhost:%d/guard/confirm", config.Opt.Advanced.StatusPort)
+	log.Warnf("[guard] reject:  curl -X POST http://localhost:%d/guard/reject", config.Opt.Advanced.StatusPort)
+
+	var timeout <-chan time.Time
+	if opts.ConfirmTimeout > 0 {
+		timeout = time.After(time.Duration(opts.ConfirmTimeout) * time.Second)
+	}
+	confirmed := false
+	select {
+	case confirmed = <-ch:
+	case <-timeout:
+		log.Warnf("[guard] confirmation timeout. cmd=[%s]", e.String())
+	}
+
+	lock.Lock()
+	pending, decision = nil, nil
+	stat.Pending, stat.PendingReason = "", ""
+	lock.Unlock()
+	if !confirmed {
+		quarantineEntry(e, reason+", rejected")
+		return false
+	}
+	log.Infof("[guard] command confirmed, write it to target. cmd=[%s]", e.String())
+	return true
+}
+
+func statusHandler(w http.ResponseWriter, _ *http.Request) {
+	lock.Lock()
+	jsonBytes, err := json.Marshal(stat)
+	lock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if _, err = w.Write(jsonBytes); err != nil {
+		log.Warnf("write guard status failed, err=[%v]", err)
+	}
+}
+
+func decisionHandler(confirmed bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if decision == nil {
+			http.Error(w, "no command is waiting for confirmation", http.StatusConflict)
+			return
+		}
+		decision <- confirmed
+		decision = nil
+		_, _ = fmt.Fprintf(w, "%s: %s\n", map[bool]string{true: "confirmed", false: "rejected"}[confirmed], pending.String())
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"github.com/rs/zerolog"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 var logger zerolog.Logger
 
-func Init(level string, file string, dir string) {
+// Init cleans dir and opens the log file in it. The checkpoints and the keep
+// files, relative to dir if not absolute, are not removed.
+func Init(level string, file string, dir string, keep ...string) {
 	// log level
 	switch level {
 	case "debug":
@@ -27,7 +30,7 @@ func Init(level string, file string, dir string) {
 	if err != nil {
 		panic(fmt.Sprintf("failed to determine current directory: %v", err))
 	}
-	err = os.RemoveAll(dir)
+	err = removeAllExceptCheckpoint(dir, keep)
 	if err != nil {
 		panic(fmt.Sprintf("remove dir failed. dir=[%s], error=[%v]", dir, err))
 	}
@@ -47,3 +50,45 @@ func Init(level string, file string, dir string) {
 	logger = zerolog.New(multi).With().Timestamp().Logger()
 	Infof("log_level: [%v], log_file: [%v]", level, path)
 }
+
+// removeAllExceptCheckpoint cleans dir but keeps the checkpoints of the
+// readers, so that a restarted redis-shake resumes from them, and the keep
+// files like the dead letter file, which are appended across restarts.
+func removeAllExceptCheckpoint(dir string, keep []string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == "checkpoint" && entry.IsDir() {
+			continue
+		}
+		if isKept(filepath.Join(dir, entry.Name()), dir, keep) {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isKept returns true if path is one of the keep files or a directory
+// containing one of them.
+func isKept(path string, dir string, keep []string) bool {
+	for _, k := range keep {
+		if k == "" {
+			continue
+		}
+		if !filepath.IsAbs(k) {
+			k = filepath.Join(dir, k)
+		}
+		k = filepath.Clean(k)
+		if k == path || strings.HasPrefix(k, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
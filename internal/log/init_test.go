@@ -0,0 +1,34 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveAllExceptCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"checkpoint/reader.json", "shake.log", "dead_letter.aof", "guard/quarantine.aof", "guard/other.aof"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := removeAllExceptCheckpoint(dir, []string{"dead_letter.aof", filepath.Join(dir, "guard/quarantine.aof"), ""}); err != nil {
+		t.Fatal(err)
+	}
+	for name, kept := range map[string]bool{
+		"checkpoint/reader.json": true,
+		"shake.log":              false,
+		"dead_letter.aof":        true,
+		"guard/quarantine.aof":   true,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if kept != (err == nil) {
+			t.Fatalf("%s kept = %v, want %v", name, err == nil, kept)
+		}
+	}
+}
@@ -46,10 +46,13 @@ type Loader struct {
 
 	name       string
 	updateFunc func(int64)
+	loadMode   string
 }
 
-func NewLoader(name string, updateFunc func(int64), filPath string, ch chan *entry.Entry) *Loader {
+func NewLoader(name string, updateFunc func(int64), filPath string, ch chan *entry.Entry, loadMode string) *Loader {
+	types.CheckLoadMode(loadMode)
 	ld := new(Loader)
+	ld.loadMode = loadMode
 	ld.ch = ch
 	ld.filPath = filPath
 	ld.name = name
@@ -157,20 +160,14 @@ func (ld *Loader) parseRDBEntry(rd *bufio.Reader) {
 			var value bytes.Buffer
 			anotherReader := io.TeeReader(rd, &value)
 			o := types.ParseObject(anotherReader, typeByte, key)
-			if uint64(value.Len()) > config.Opt.Advanced.TargetRedisProtoMaxBulkLen {
-				cmds := o.Rewrite()
-				for _, cmd := range cmds {
+			if ld.loadMode == types.LoadModeRewrite || uint64(value.Len()) > config.Opt.Advanced.TargetRedisProtoMaxBulkLen {
+				replace := config.Opt.Advanced.RDBRestoreCommandBehavior == "rewrite"
+				for _, cmd := range types.RewriteKey(o, key, ld.expireMs, replace) {
 					e := entry.NewEntry()
 					e.DbId = ld.nowDBId
 					e.Argv = cmd
 					ld.ch <- e
 				}
-				if ld.expireMs != 0 {
-					e := entry.NewEntry()
-					e.DbId = ld.nowDBId
-					e.Argv = []string{"PEXPIRE", key, strconv.FormatInt(ld.expireMs, 10)}
-					ld.ch <- e
-				}
 			} else {
 				e := entry.NewEntry()
 				e.DbId = ld.nowDBId
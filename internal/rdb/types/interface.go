@@ -66,6 +66,26 @@ type RedisObject interface {
 	Rewrite() []RedisCmd
 }
 
+// TypeName returns the type of the value reported by the TYPE command, or an
+// empty string for module types.
+func TypeName(typeByte byte) string {
+	switch typeByte {
+	case rdbTypeString:
+		return "string"
+	case rdbTypeList, rdbTypeListZiplist, rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return "list"
+	case rdbTypeSet, rdbTypeSetIntset, rdbTypeSetListpack:
+		return "set"
+	case rdbTypeZSet, rdbTypeZSet2, rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		return "zset"
+	case rdbTypeHash, rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack:
+		return "hash"
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return "stream"
+	}
+	return ""
+}
+
 func ParseObject(rd io.Reader, typeByte byte, key string) RedisObject {
 	switch typeByte {
 	case rdbTypeString: // string
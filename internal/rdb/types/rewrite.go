@@ -0,0 +1,75 @@
+package types
+
+import (
+	"RedisShake/internal/log"
+	"strconv"
+	"strings"
+)
+
+// Load modes of the readers that load keys from RDB or DUMP payloads.
+const (
+	LoadModeRestore = "restore" // create keys with RESTORE
+	LoadModeRewrite = "rewrite" // create keys with type-native commands, e.g. SET, RPUSH, HSET
+)
+
+const (
+	rewriteChunkCount = 128         // max commands merged into one
+	rewriteChunkBytes = 1024 * 1024 // max bytes of arguments merged into one command
+)
+
+// variadicCommands are the commands of Rewrite() that accept several elements.
+var variadicCommands = map[string]bool{
+	"rpush": true,
+	"sadd":  true,
+	"hset":  true,
+	"zadd":  true,
+}
+
+func CheckLoadMode(loadMode string) {
+	if loadMode != LoadModeRestore && loadMode != LoadModeRewrite {
+		log.Panicf("invalid load_mode: [%s], must be one of restore or rewrite", loadMode)
+	}
+}
+
+// RewriteKey returns the commands that create the key without RESTORE: DEL if
+// replace is true, the commands of o.Rewrite() merged into chunks, and
+// PEXPIRE if pttl is greater than 0.
+func RewriteKey(o RedisObject, key string, pttl int64, replace bool) []RedisCmd {
+	var cmds []RedisCmd
+	if replace {
+		cmds = append(cmds, RedisCmd{"del", key})
+	}
+	cmds = append(cmds, mergeCommands(o.Rewrite())...)
+	if pttl > 0 {
+		cmds = append(cmds, RedisCmd{"pexpire", key, strconv.FormatInt(pttl, 10)})
+	}
+	return cmds
+}
+
+// mergeCommands merges adjacent variadic commands on the same key, e.g.
+// "rpush k a" and "rpush k b" into "rpush k a b".
+func mergeCommands(cmds []RedisCmd) []RedisCmd {
+	var merged []RedisCmd
+	var last RedisCmd
+	count, size := 0, 0
+	for _, cmd := range cmds {
+		if len(cmd) > 2 && last != nil && variadicCommands[strings.ToLower(cmd[0])] &&
+			strings.EqualFold(cmd[0], last[0]) && cmd[1] == last[1] &&
+			count < rewriteChunkCount && size < rewriteChunkBytes {
+			last = append(last, cmd[2:]...)
+			merged[len(merged)-1] = last
+			count++
+			for _, arg := range cmd[2:] {
+				size += len(arg)
+			}
+			continue
+		}
+		last = append(RedisCmd{}, cmd...)
+		merged = append(merged, last)
+		count, size = 1, 0
+		for _, arg := range cmd[2:] {
+			size += len(arg)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,32 @@
+package types
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRewriteKey(t *testing.T) {
+	o := new(ListObject)
+	o.key = "key"
+	for i := 0; i < rewriteChunkCount+1; i++ {
+		o.elements = append(o.elements, strconv.Itoa(i))
+	}
+	cmds := RewriteKey(o, "key", 100, true)
+	if len(cmds) != 4 {
+		t.Fatalf("RewriteKey failed. len(cmds)=[%d]", len(cmds))
+	}
+	if strings.Join(cmds[0], " ") != "del key" || strings.Join(cmds[3], " ") != "pexpire key 100" {
+		t.Errorf("RewriteKey failed. cmds[0]=%v, cmds[3]=%v", cmds[0], cmds[3])
+	}
+	if len(cmds[1]) != 2+rewriteChunkCount || cmds[1][2] != "0" || strings.Join(cmds[2], " ") != "rpush key "+strconv.Itoa(rewriteChunkCount) {
+		t.Errorf("RewriteKey failed. len(cmds[1])=[%d], cmds[2]=%v", len(cmds[1]), cmds[2])
+	}
+
+	s := new(StringObject)
+	s.key, s.value = "key", "value"
+	cmds = RewriteKey(s, "key", 0, false)
+	if len(cmds) != 1 || strings.Join(cmds[0], " ") != "set key value" {
+		t.Errorf("RewriteKey failed. cmds=%v", cmds)
+	}
+}
@@ -0,0 +1,296 @@
+package reader
+
+import (
+	"RedisShake/internal/deadletter"
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"fmt"
+	"github.com/mcuadros/go-defaults"
+	"github.com/spf13/viper"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Conflict policies of the merge reader when two sources write the same key.
+// none:        write the entries of all the sources.
+// priority:    the source with the higher priority takes the key over.
+// skip:        the first source writing the key owns it, the others are skipped.
+// dead_letter: like skip, but the entries are appended to the dead letter file.
+const (
+	ConflictPolicyNone       = "none"
+	ConflictPolicyPriority   = "priority"
+	ConflictPolicySkip       = "skip"
+	ConflictPolicyDeadLetter = "dead_letter"
+)
+
+type MergeReaderOptions struct {
+	Sources        []MergeSourceOptions `mapstructure:"sources"`
+	ConflictPolicy string               `mapstructure:"conflict_policy" default:"none"`
+
+	// Keys are prefixed on the way to the target by fold_db of the writer.
+	// Set by the caller, not by the config.
+	KeysPrefixed bool `mapstructure:"-"`
+}
+
+type MergeSourceOptions struct {
+	Name     string `mapstructure:"name" default:""`
+	Type     string `mapstructure:"type" default:""` // sync, scan, rdb or aof
+	Priority int    `mapstructure:"priority" default:"0"`
+	// Map the db of the source to the db of the target, e.g. {"0" = 1}.
+	DbMapping map[string]int `mapstructure:"db_mapping"`
+	// Prepend the prefix to every key of the source, must not contain '{'.
+	KeyPrefix string `mapstructure:"key_prefix" default:""`
+	// The options of the reader, the same as sync_reader, scan_reader,
+	// rdb_reader or aof_reader.
+	Options map[string]interface{} `mapstructure:",remain"`
+}
+
+type mergeSource struct {
+	name      string
+	priority  int
+	dbMapping map[int]int
+	keyPrefix string
+	reader    Reader
+}
+
+type mergeReader struct {
+	sources  []*mergeSource
+	policy   string
+	statusId int
+
+	lock   sync.Mutex
+	owners map[uint64]int // hash of db and key -> index of the source writing it
+
+	sendLock sync.Mutex
+
+	conflictCount int64
+	skippedCount  int64
+}
+
+func NewMergeReader(opts *MergeReaderOptions) Reader {
+	if len(opts.Sources) == 0 {
+		log.Panicf("merge_reader requires at least one source")
+	}
+	switch opts.ConflictPolicy {
+	case ConflictPolicyNone, ConflictPolicyPriority, ConflictPolicySkip, ConflictPolicyDeadLetter:
+	default:
+		log.Panicf("invalid merge_reader conflict_policy: [%s], must be one of none, priority, skip or dead_letter", opts.ConflictPolicy)
+	}
+	rd := &mergeReader{policy: opts.ConflictPolicy, owners: make(map[uint64]int)}
+	names := make(map[string]bool)
+	for i := range opts.Sources {
+		sourceOpts := &opts.Sources[i]
+		if sourceOpts.Name == "" {
+			sourceOpts.Name = fmt.Sprintf("source-%d", i)
+		}
+		if names[sourceOpts.Name] {
+			log.Panicf("duplicate merge_reader source name: [%s]", sourceOpts.Name)
+		}
+		names[sourceOpts.Name] = true
+		rd.sources = append(rd.sources, newMergeSource(sourceOpts, opts.KeysPrefixed))
+	}
+	return rd
+}
+
+func newMergeSource(opts *MergeSourceOptions, keysPrefixed bool) *mergeSource {
+	s := &mergeSource{name: opts.Name, priority: opts.Priority, keyPrefix: opts.KeyPrefix}
+	if strings.Contains(s.keyPrefix, "{") {
+		log.Panicf("key_prefix must not contain '{', otherwise hash tags of keys will be broken. source=[%s], key_prefix=[%s]", s.name, s.keyPrefix)
+	}
+	s.dbMapping = make(map[int]int)
+	for source, target := range opts.DbMapping {
+		sourceDbId, err := strconv.Atoi(source)
+		if err != nil || sourceDbId < 0 || target < 0 {
+			log.Panicf("invalid db_mapping of source [%s]. source db=[%s], target db=[%d]", s.name, source, target)
+		}
+		s.dbMapping[sourceDbId] = target
+	}
+
+	v := viper.New()
+	if err := v.MergeConfigMap(opts.Options); err != nil {
+		log.Panicf("failed to read the options of source [%s]. err: %v", s.name, err)
+	}
+	unmarshal := func(typedOpts interface{}) {
+		defaults.SetDefaults(typedOpts)
+		if err := v.Unmarshal(typedOpts); err != nil {
+			log.Panicf("failed to read the options of source [%s]. err: %v", s.name, err)
+		}
+	}
+	switch opts.Type {
+	case "sync":
+		typedOpts := new(SyncReaderOptions)
+		unmarshal(typedOpts)
+		if typedOpts.Cluster {
+			s.reader = NewSyncClusterReader(typedOpts)
+		} else {
+			s.reader = NewSyncStandaloneReader(typedOpts)
+		}
+	case "scan":
+		typedOpts := new(ScanReaderOptions)
+		unmarshal(typedOpts)
+		typedOpts.KeysPrefixed = keysPrefixed || s.keyPrefix != ""
+		if typedOpts.Cluster {
+			s.reader = NewScanClusterReader(typedOpts)
+		} else {
+			s.reader = NewScanStandaloneReader(typedOpts)
+		}
+	case "rdb":
+		typedOpts := new(RdbReaderOptions)
+		unmarshal(typedOpts)
+		s.reader = NewRDBReader(typedOpts)
+	case "aof":
+		typedOpts := new(AOFReaderOptions)
+		unmarshal(typedOpts)
+		s.reader = NewAOFReader(typedOpts)
+	default:
+		log.Panicf("invalid type of source [%s]: [%s], must be one of sync, scan, rdb or aof", s.name, opts.Type)
+	}
+	log.Infof("create merge source [%s], type=[%s], priority=[%d]", s.name, opts.Type, s.priority)
+	return s
+}
+
+// apply maps the db and the keys of the entry for the target.
+func (s *mergeSource) apply(e *entry.Entry) {
+	if target, ok := s.dbMapping[e.DbId]; ok {
+		e.DbId = target
+	}
+	if s.keyPrefix != "" {
+		e.AddKeyPrefix(s.keyPrefix)
+	}
+}
+
+func (rd *mergeReader) StartRead() chan *entry.Entry {
+	ch := make(chan *entry.Entry, 1024)
+	var wg sync.WaitGroup
+	for i, s := range rd.sources {
+		wg.Add(1)
+		go func(i int, s *mergeSource) {
+			defer wg.Done()
+			var transaction []*entry.Entry // from MULTI, sent together at EXEC or DISCARD
+			for e := range s.reader.StartRead() {
+				if e.Checkpoint != nil {
+					rd.send(ch, e)
+					continue
+				}
+				if e.CmdName == "" { // the keys are needed to map and claim
+					e.Parse()
+				}
+				s.apply(e)
+				switch {
+				case e.CmdName == "MULTI":
+					transaction = []*entry.Entry{e}
+					continue
+				case transaction == nil:
+					if rd.claim(i, e) {
+						rd.send(ch, e)
+					}
+					continue
+				case e.CmdName != "EXEC" && e.CmdName != "DISCARD":
+					if rd.claim(i, e) {
+						transaction = append(transaction, e)
+					}
+					continue
+				}
+				if len(transaction) > 1 { // not all the commands skipped
+					rd.send(ch, append(transaction, e)...)
+				}
+				transaction = nil
+			}
+		}(i, s)
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+// send sends the entries without the entries of other sources in between, so
+// that the transactions of the sources are not interleaved.
+func (rd *mergeReader) send(ch chan *entry.Entry, entries ...*entry.Entry) {
+	rd.sendLock.Lock()
+	defer rd.sendLock.Unlock()
+	for _, e := range entries {
+		ch <- e
+	}
+}
+
+func ownerKey(dbId int, key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(strconv.Itoa(dbId)))
+	_, _ = h.Write([]byte{':'})
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// claim records the source as the owner of the keys of the entry, and returns
+// false if the entry should not be written because of the conflict policy.
+func (rd *mergeReader) claim(index int, e *entry.Entry) bool {
+	if rd.policy == ConflictPolicyNone || len(e.Keys) == 0 {
+		return true
+	}
+	rd.lock.Lock()
+	conflict := -1
+	for _, key := range e.Keys {
+		owner, ok := rd.owners[ownerKey(e.DbId, key)]
+		if !ok || owner == index {
+			continue
+		}
+		rd.conflictCount++
+		if rd.policy != ConflictPolicyPriority || rd.sources[owner].priority > rd.sources[index].priority {
+			conflict = owner
+			break
+		}
+	}
+	if conflict == -1 {
+		for _, key := range e.Keys {
+			rd.owners[ownerKey(e.DbId, key)] = index
+		}
+	} else {
+		rd.skippedCount++
+	}
+	rd.lock.Unlock()
+	if conflict == -1 {
+		return true
+	}
+
+	reason := fmt.Sprintf("key is written by source [%s], conflicts with source [%s]", rd.sources[conflict].name, rd.sources[index].name)
+	if rd.policy == ConflictPolicyDeadLetter {
+		deadletter.Reject(deadletter.BehaviorDeadLetter, e, reason)
+	} else {
+		log.Debugf("%s, skip it. cmd=[%s]", reason, e.String())
+	}
+	return false
+}
+
+func (rd *mergeReader) Status() interface{} {
+	sources := make(map[string]interface{}, len(rd.sources))
+	for _, s := range rd.sources {
+		sources[s.name] = s.reader.Status()
+	}
+	rd.lock.Lock()
+	defer rd.lock.Unlock()
+	return map[string]interface{}{
+		"sources":        sources,
+		"conflict_count": rd.conflictCount,
+		"skipped_count":  rd.skippedCount,
+	}
+}
+
+func (rd *mergeReader) StatusString() string {
+	rd.statusId += 1
+	rd.statusId %= len(rd.sources)
+	s := rd.sources[rd.statusId]
+	return fmt.Sprintf("%s, %s", s.name, s.reader.StatusString())
+}
+
+func (rd *mergeReader) StatusConsistent() bool {
+	for _, s := range rd.sources {
+		if !s.reader.StatusConsistent() {
+			return false
+		}
+	}
+	return true
+}
@@ -4,6 +4,7 @@ import (
 	"RedisShake/internal/entry"
 	"RedisShake/internal/log"
 	"RedisShake/internal/rdb"
+	"RedisShake/internal/rdb/types"
 	"RedisShake/internal/utils"
 	"fmt"
 	"github.com/dustin/go-humanize"
@@ -11,10 +12,12 @@ import (
 
 type RdbReaderOptions struct {
 	Filepath string `mapstructure:"filepath" default:""`
+	LoadMode string `mapstructure:"load_mode" default:"restore"` // restore or rewrite
 }
 
 type rdbReader struct {
-	ch chan *entry.Entry
+	ch       chan *entry.Entry
+	loadMode string
 
 	stat struct {
 		Name          string `json:"name"`
@@ -30,7 +33,9 @@ type rdbReader struct {
 
 func NewRDBReader(opts *RdbReaderOptions) Reader {
 	absolutePath := utils.GetAbsPath(opts.Filepath)
+	types.CheckLoadMode(opts.LoadMode)
 	r := new(rdbReader)
+	r.loadMode = opts.LoadMode
 	r.stat.Name = "rdb_reader"
 	r.stat.Status = "init"
 	r.stat.Filepath = absolutePath
@@ -48,7 +53,7 @@ func (r *rdbReader) StartRead() chan *entry.Entry {
 		r.stat.Percent = fmt.Sprintf("%.2f%%", float64(offset)/float64(r.stat.FileSizeBytes)*100)
 		r.stat.Status = fmt.Sprintf("[%s] rdb file synced: %s", r.stat.Name, r.stat.Percent)
 	}
-	rdbLoader := rdb.NewLoader(r.stat.Name, updateFunc, r.stat.Filepath, r.ch)
+	rdbLoader := rdb.NewLoader(r.stat.Name, updateFunc, r.stat.Filepath, r.ch, r.loadMode)
 
 	go func() {
 		_ = rdbLoader.ParseRDB()
@@ -0,0 +1,142 @@
+package reader
+
+import (
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"RedisShake/internal/utils"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const scanCheckpointInterval = 1 * time.Second
+
+// scanPosition is where the scan continues, index is the index in dbs and
+// index == len(dbs) means the scan is finished. In slot mode, index is the
+// slot number to continue from and clusterSlots means the scan is finished.
+// Then the slots with too many keys are scanned by SCAN from cursor, large is
+// the number of such slots found before the position.
+// It is put into the key queue after the keys scanned before it.
+type scanPosition struct {
+	index  int
+	cursor uint64
+	large  int
+}
+
+type scanCheckpoint struct {
+	Dbs   []int `json:"dbs"`
+	Slots []int `json:"slots,omitempty"` // the slots to scan in slot mode
+	Slot  int   `json:"slot,omitempty"`  // the slot to continue from in slot mode
+	// the slots with more than count keys before the slot, scanned by SCAN
+	// from cursor after all the slots
+	LargeSlots []int  `json:"large_slots,omitempty"`
+	Index      int    `json:"index"`
+	Cursor     uint64 `json:"cursor"`
+}
+
+func (r *scanStandaloneReader) checkpointPath() string {
+	return filepath.Join(utils.GetAbsPath("checkpoint"), r.stat.Name+".json")
+}
+
+// loadCheckpoint returns the position saved by the last run, or the
+// beginning if there is none.
+func (r *scanStandaloneReader) loadCheckpoint() scanPosition {
+	path := r.checkpointPath()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return scanPosition{}
+	} else if err != nil {
+		log.Panicf("[%s] read checkpoint failed. file=[%s], err=[%v]", r.stat.Name, path, err)
+	}
+	var cp scanCheckpoint
+	if err = json.Unmarshal(data, &cp); err != nil {
+		log.Panicf("[%s] parse checkpoint failed. file=[%s], err=[%v]", r.stat.Name, path, err)
+	}
+	if r.opts.SlotMode {
+		return r.loadSlotCheckpoint(cp, path)
+	}
+	if !reflect.DeepEqual(cp.Dbs, r.dbs) || cp.Index < 0 || cp.Index > len(r.dbs) {
+		log.Warnf("[%s] checkpoint does not match dbs, scan from the beginning. file=[%s]", r.stat.Name, path)
+		return scanPosition{}
+	}
+	if cp.Index == len(r.dbs) {
+		log.Infof("[%s] scan is finished by the last run. file=[%s]", r.stat.Name, path)
+	} else {
+		log.Infof("[%s] resume scan from db=[%d], cursor=[%d]. file=[%s]", r.stat.Name, r.dbs[cp.Index], cp.Cursor, path)
+	}
+	return scanPosition{index: cp.Index, cursor: cp.Cursor}
+}
+
+// loadSlotCheckpoint returns the position saved by the last run in slot mode.
+// The slots to scan may be changed, e.g. after resharding, the slots before
+// the saved slot must be scanned by the last run.
+func (r *scanStandaloneReader) loadSlotCheckpoint(cp scanCheckpoint, path string) scanPosition {
+	scanned := make(map[int]bool, len(cp.Slots))
+	for _, slot := range cp.Slots {
+		scanned[slot] = true
+	}
+	for _, slot := range r.slots {
+		if slot < cp.Slot && !scanned[slot] {
+			log.Warnf("[%s] slot [%d] is not scanned by the last run, scan from the beginning. file=[%s]", r.stat.Name, slot, path)
+			return scanPosition{}
+		}
+	}
+	if cp.Slot < 0 || cp.Slot > clusterSlots {
+		log.Warnf("[%s] invalid slot [%d] in checkpoint, scan from the beginning. file=[%s]", r.stat.Name, cp.Slot, path)
+		return scanPosition{}
+	}
+	var largeSlots []int
+	for _, slot := range cp.LargeSlots {
+		if i := sort.SearchInts(r.slots, slot); i < len(r.slots) && r.slots[i] == slot {
+			largeSlots = append(largeSlots, slot)
+		}
+	}
+	r.setLargeSlots(largeSlots)
+	if cp.Slot == clusterSlots && len(largeSlots) == 0 {
+		log.Infof("[%s] scan is finished by the last run. file=[%s]", r.stat.Name, path)
+	} else if cp.Slot == clusterSlots {
+		log.Infof("[%s] resume scan of %d slots with too many keys from cursor=[%d]. file=[%s]", r.stat.Name, len(largeSlots), cp.Cursor, path)
+	} else {
+		log.Infof("[%s] resume scan from slot=[%d]. file=[%s]", r.stat.Name, cp.Slot, path)
+	}
+	return scanPosition{index: cp.Slot, cursor: cp.Cursor, large: len(largeSlots)}
+}
+
+func (r *scanStandaloneReader) saveCheckpoint(pos scanPosition) {
+	path := r.checkpointPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		log.Panicf("[%s] mkdir failed. dir=[%s], err=[%v]", r.stat.Name, filepath.Dir(path), err)
+	}
+	cp := scanCheckpoint{Dbs: r.dbs, Index: pos.index, Cursor: pos.cursor}
+	if r.opts.SlotMode {
+		largeSlots := r.getLargeSlots()
+		if pos.large < len(largeSlots) {
+			largeSlots = largeSlots[:pos.large]
+		}
+		cp = scanCheckpoint{Dbs: r.dbs, Slots: r.slots, Slot: pos.index, LargeSlots: largeSlots, Cursor: pos.cursor}
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		log.Panicf(err.Error())
+	}
+	// write to a temporary file first, the checkpoint is never half written
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0666); err != nil {
+		log.Panicf("[%s] write checkpoint failed. file=[%s], err=[%v]", r.stat.Name, tmp, err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		log.Panicf("[%s] write checkpoint failed. file=[%s], err=[%v]", r.stat.Name, path, err)
+	}
+	log.Debugf("[%s] save checkpoint. index=[%d], cursor=[%d]", r.stat.Name, pos.index, pos.cursor)
+}
+
+// newCheckpointEntry returns the entry to save the position after the keys
+// before it are written to the target.
+func (r *scanStandaloneReader) newCheckpointEntry(pos scanPosition) *entry.Entry {
+	return &entry.Entry{Checkpoint: func() {
+		r.saveCheckpoint(pos)
+	}}
+}
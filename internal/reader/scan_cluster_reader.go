@@ -13,12 +13,13 @@ type scanClusterReader struct {
 }
 
 func NewScanClusterReader(opts *ScanReaderOptions) Reader {
-	addresses, _ := utils.GetRedisClusterNodes(opts.Address, opts.Username, opts.Password, opts.Tls)
+	addresses, slots := utils.GetRedisClusterNodes(opts.Address, opts.Username, opts.Password, opts.Tls)
 
 	rd := &scanClusterReader{}
-	for _, address := range addresses {
+	for i, address := range addresses {
 		theOpts := *opts
 		theOpts.Address = address
+		theOpts.nodeSlots = slots[i]
 		rd.readers = append(rd.readers, NewScanStandaloneReader(&theOpts))
 	}
 	return rd
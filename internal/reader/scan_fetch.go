@@ -0,0 +1,296 @@
+package reader
+
+import (
+	"RedisShake/internal/client"
+	"RedisShake/internal/client/proto"
+	"RedisShake/internal/config"
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"RedisShake/internal/rdb/types"
+	"RedisShake/internal/utils"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fetchBarrier is passed to all the fetchers, the checkpoint is sent after
+// the last fetcher passed it, so that the keys before it are all sent.
+type fetchBarrier struct {
+	pos       scanPosition
+	remaining int32
+}
+
+// keyCapture decides how the value and the TTL of a key are read together.
+type keyCapture struct {
+	multi  bool // MULTI and EXEC if scripting is not available
+	absTTL bool // PEXPIRETIME instead of PTTL, Redis 7.0+
+}
+
+// captureScript reads the value and the TTL of the key atomically, %s is
+// PTTL or PEXPIRETIME.
+const captureScript = "return {redis.call('DUMP', KEYS[1]), redis.call('%s', KEYS[1])}"
+
+func (r *scanStandaloneReader) detectCapture() keyCapture {
+	c := client.NewRedisClientWithProtocol(r.opts.Address, r.opts.Username, r.opts.Password, r.opts.Tls, r.opts.Protocol)
+	defer c.Close()
+	var capture keyCapture
+	version := c.ServerVersion()
+	if major, err := strconv.Atoi(strings.Split(version, ".")[0]); err == nil && major >= 7 {
+		capture.absTTL = true
+	}
+	c.Send("EVAL", "return 1", "0")
+	if _, err := c.Receive(); err != nil {
+		log.Warnf("[%s] scripting is not available on the source, read keys with MULTI and EXEC. err=[%v]", r.stat.Name, err)
+		capture.multi = true
+	}
+	log.Infof("[%s] source version=[%s], capture keys with multi=[%v], abs_ttl=[%v]", r.stat.Name, version, capture.multi, capture.absTTL)
+	return capture
+}
+
+func (capture keyCapture) ttlCommand() string {
+	if capture.absTTL {
+		return "PEXPIRETIME"
+	}
+	return "PTTL"
+}
+
+// send sends the commands to read the value and the TTL of the key.
+func (capture keyCapture) send(c *client.Redis, key string) {
+	if capture.multi {
+		c.Send("MULTI")
+		c.Send("DUMP", key)
+		c.Send(capture.ttlCommand(), key)
+		c.Send("EXEC")
+		return
+	}
+	c.Send("EVAL", fmt.Sprintf(captureScript, capture.ttlCommand()), "1", key)
+}
+
+// receive returns the replies of DUMP and PTTL or PEXPIRETIME.
+func (capture keyCapture) receive(c *client.Redis) (iDump interface{}, err1 error, iTTL interface{}, err2 error) {
+	var queueErr error
+	if capture.multi {
+		for i := 0; i < 3; i++ { // MULTI, DUMP and TTL
+			if _, err := c.Receive(); err != nil && queueErr == nil {
+				queueErr = err
+			}
+		}
+	}
+	reply, err := c.Receive()
+	return captureReplies(reply, err, queueErr)
+}
+
+// captureReplies splits the reply of EVAL or EXEC into the replies of DUMP
+// and PTTL or PEXPIRETIME. queueErr is the first error replied while queueing
+// the commands of MULTI, which explains an EXECABORT.
+func captureReplies(reply interface{}, err error, queueErr error) (iDump interface{}, err1 error, iTTL interface{}, err2 error) {
+	if err != nil {
+		if queueErr != nil {
+			err = queueErr
+		}
+		return nil, err, nil, err
+	}
+	replies, ok := reply.([]interface{})
+	if !ok || len(replies) != 2 {
+		err = fmt.Errorf("unexpected reply when reading the key: %v", reply)
+		return nil, err, nil, err
+	}
+	return replyValue(replies[0]), replyError(replies[0]), replyValue(replies[1]), replyError(replies[1])
+}
+
+func replyValue(v interface{}) interface{} {
+	if _, ok := v.(proto.RedisError); ok {
+		return nil
+	}
+	return v
+}
+
+func replyError(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		return proto.Nil
+	case proto.RedisError:
+		return v
+	}
+	return nil
+}
+
+type fetchedKey struct {
+	dbKey
+	selected bool // SELECT is sent before the key
+}
+
+func (r *scanStandaloneReader) fetch() {
+	n := r.opts.FetchConcurrency
+	if n < 1 || r.opts.FetchBatchSize < 1 {
+		log.Panicf("[%s] invalid fetch_concurrency=[%d] or fetch_batch_size=[%d], must be positive", r.stat.Name, n, r.opts.FetchBatchSize)
+	}
+	capture := r.detectCapture()
+	chs := make([]chan interface{}, n)
+	var wg sync.WaitGroup
+	for i := range chs {
+		chs[i] = make(chan interface{}, 2*r.opts.FetchBatchSize)
+		wg.Add(1)
+		go func(ch chan interface{}) {
+			defer wg.Done()
+			r.fetcher(ch, capture)
+		}(chs[i])
+	}
+
+	for item := range r.keyQueue.Ch {
+		r.stat.NeedUpdateCount = int64(r.keyQueue.Len())
+		r.stat.SpilledCount = int64(r.keyQueue.Spilled())
+		switch v := item.(type) {
+		case scanPosition:
+			b := &fetchBarrier{pos: v, remaining: int32(n)}
+			for _, ch := range chs {
+				ch <- b
+			}
+		case dbKey:
+			chs[int(utils.Crc16(v.key))%n] <- v
+		}
+	}
+	for _, ch := range chs {
+		close(ch)
+	}
+	wg.Wait()
+
+	log.Infof("[%s] scanStandaloneReader fetch finished.", r.stat.Name)
+	close(r.ch)
+}
+
+// fetcher fetches the keys in batches on its own connection.
+func (r *scanStandaloneReader) fetcher(ch chan interface{}, capture keyCapture) {
+	c := client.NewRedisClientWithProtocol(r.opts.Address, r.opts.Username, r.opts.Password, r.opts.Tls, r.opts.Protocol)
+	defer c.Close()
+	nowDbId := 0
+	batch := make([]fetchedKey, 0, r.opts.FetchBatchSize)
+	for item := range ch {
+		if b, ok := item.(*fetchBarrier); ok {
+			r.passBarrier(b)
+			continue
+		}
+		batch = append(batch[:0], fetchedKey{dbKey: item.(dbKey)})
+		var barrier *fetchBarrier
+	collect:
+		for len(batch) < r.opts.FetchBatchSize {
+			select {
+			case item, ok := <-ch:
+				if !ok {
+					break collect
+				}
+				if b, isBarrier := item.(*fetchBarrier); isBarrier {
+					barrier = b
+					break collect
+				}
+				batch = append(batch, fetchedKey{dbKey: item.(dbKey)})
+			default:
+				break collect
+			}
+		}
+		nowDbId = r.fetchBatch(c, capture, nowDbId, batch)
+		if barrier != nil {
+			r.passBarrier(barrier)
+		}
+	}
+}
+
+func (r *scanStandaloneReader) passBarrier(b *fetchBarrier) {
+	if atomic.AddInt32(&b.remaining, -1) == 0 {
+		r.ch <- r.newCheckpointEntry(b.pos)
+	}
+}
+
+// fetchBatch reads all the keys in one round trip, and returns the db
+// selected on the connection.
+func (r *scanStandaloneReader) fetchBatch(c *client.Redis, capture keyCapture, nowDbId int, batch []fetchedKey) int {
+	if r.largeKeyEnabled() {
+		batch, nowDbId = r.copyLargeKeys(c, nowDbId, batch)
+	}
+	r.throttle.waitKeys(len(batch))
+	for i := range batch {
+		if batch[i].db != nowDbId {
+			c.Send("SELECT", strconv.Itoa(batch[i].db))
+			batch[i].selected = true
+			nowDbId = batch[i].db
+		}
+		capture.send(c, batch[i].key)
+	}
+	for _, k := range batch {
+		if k.selected {
+			if reply, err := c.Receive(); err != nil || reply != "OK" {
+				log.Panicf("scanStandaloneReader select db failed. db=[%d], err=[%v]", k.db, err)
+			}
+		}
+		iDump, err1, iTTL, err2 := capture.receive(c)
+		if dump, ok := iDump.(string); ok {
+			r.throttle.waitBytes(len(dump))
+		}
+		r.sendKey(k.db, k.key, capture.absTTL, iDump, err1, iTTL, err2)
+	}
+	return nowDbId
+}
+
+// sendKey sends the commands to create the key on the target from the
+// replies of DUMP and PTTL, or PEXPIRETIME if absTTL is true.
+func (r *scanStandaloneReader) sendKey(dbId int, key string, absTTL bool, iDump interface{}, err1 error, iTTL interface{}, err2 error) {
+	if err1 == proto.Nil {
+		r.deleteVanishedKey(dbId, key)
+		return // key not exist
+	} else if err1 != nil {
+		log.Panicf(err1.Error())
+	} else if err2 != nil {
+		log.Panicf(err2.Error())
+	}
+	dump := iDump.(string)
+	if r.opts.KeyType != "" && types.TypeName(dump[0]) != r.opts.KeyType {
+		return // notified by KSN, but not of the type
+	}
+	ttl := iTTL.(int64)
+	if ttl == -2 {
+		r.deleteVanishedKey(dbId, key)
+		return // key not exist
+	}
+	if ttl == -1 {
+		ttl = 0 // -1 means no expire
+		absTTL = false
+	}
+	pttl := ttl
+	if absTTL {
+		pttl = ttl - time.Now().UnixMilli()
+		if pttl <= 0 {
+			r.deleteVanishedKey(dbId, key)
+			return // key expired
+		}
+	}
+	if r.opts.LoadMode == types.LoadModeRewrite || uint64(len(dump)) > config.Opt.Advanced.TargetRedisProtoMaxBulkLen {
+		if r.opts.LoadMode != types.LoadModeRewrite {
+			log.Warnf("key=[%s] dump len=[%d] too large, split it. This is not a good practice in Redis.", key, len(dump))
+		}
+		typeByte := dump[0]
+		anotherReader := strings.NewReader(dump[1 : len(dump)-10])
+		o := types.ParseObject(anotherReader, typeByte, key)
+		replace := config.Opt.Advanced.RDBRestoreCommandBehavior == "rewrite"
+		for _, cmd := range types.RewriteKey(o, key, pttl, replace) {
+			e := entry.NewEntry()
+			e.DbId = dbId
+			e.Argv = cmd
+			r.ch <- e
+		}
+	} else {
+		argv := []string{"RESTORE", key, strconv.FormatInt(ttl, 10), dump}
+		if absTTL {
+			argv = append(argv, "ABSTTL")
+		}
+		if config.Opt.Advanced.RDBRestoreCommandBehavior == "rewrite" {
+			argv = append(argv, "replace")
+		}
+		r.ch <- &entry.Entry{
+			DbId: dbId,
+			Argv: argv,
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package reader
+
+import (
+	"RedisShake/internal/client/proto"
+	"errors"
+	"testing"
+)
+
+func TestCaptureReplies(t *testing.T) {
+	execAbort := proto.RedisError("EXECABORT Transaction discarded because of previous errors.")
+	noPerm := proto.RedisError("NOPERM this user has no permissions to run the 'dump' command")
+	cases := []struct {
+		name     string
+		reply    interface{}
+		err      error
+		queueErr error
+		dump     interface{}
+		dumpErr  error
+		ttl      interface{}
+		ttlErr   error
+	}{
+		{name: "value and ttl", reply: []interface{}{"payload", int64(100)}, dump: "payload", ttl: int64(100)},
+		{name: "key vanished", reply: []interface{}{nil, int64(-2)}, dumpErr: proto.Nil, ttl: int64(-2)},
+		{name: "error of a command", reply: []interface{}{noPerm, int64(-1)}, dumpErr: noPerm, ttl: int64(-1)},
+		{name: "error of the script", err: noPerm, dumpErr: noPerm, ttlErr: noPerm},
+		{name: "aborted transaction", err: execAbort, queueErr: noPerm, dumpErr: noPerm, ttlErr: noPerm},
+		{name: "unexpected reply", reply: "OK", dumpErr: errors.New("unexpected reply when reading the key: OK"), ttlErr: errors.New("unexpected reply when reading the key: OK")},
+	}
+	sameError := func(a, b error) bool {
+		return (a == nil) == (b == nil) && (a == nil || a.Error() == b.Error())
+	}
+	for _, c := range cases {
+		dump, dumpErr, ttl, ttlErr := captureReplies(c.reply, c.err, c.queueErr)
+		if dump != c.dump || ttl != c.ttl || !sameError(dumpErr, c.dumpErr) || !sameError(ttlErr, c.ttlErr) {
+			t.Errorf("%s: captureReplies = (%v, %v, %v, %v), want (%v, %v, %v, %v)",
+				c.name, dump, dumpErr, ttl, ttlErr, c.dump, c.dumpErr, c.ttl, c.ttlErr)
+		}
+	}
+}
+
+func TestKeyCaptureTTLCommand(t *testing.T) {
+	if got := (keyCapture{}).ttlCommand(); got != "PTTL" {
+		t.Errorf("ttlCommand() = %s, want PTTL", got)
+	}
+	if got := (keyCapture{absTTL: true}).ttlCommand(); got != "PEXPIRETIME" {
+		t.Errorf("ttlCommand() with abs ttl = %s, want PEXPIRETIME", got)
+	}
+}
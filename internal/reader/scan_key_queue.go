@@ -0,0 +1,44 @@
+package reader
+
+import (
+	"RedisShake/internal/log"
+	"encoding/binary"
+)
+
+// scanQueueCodec encodes the items of the key queue, dbKey and scanPosition,
+// to spill them to disk.
+type scanQueueCodec struct{}
+
+const (
+	queueItemKey      = 'k'
+	queueItemPosition = 'p'
+)
+
+func (scanQueueCodec) Encode(item interface{}) []byte {
+	switch v := item.(type) {
+	case dbKey:
+		buf := binary.AppendUvarint([]byte{queueItemKey}, uint64(v.db))
+		return append(buf, v.key...)
+	case scanPosition:
+		buf := binary.AppendUvarint([]byte{queueItemPosition}, uint64(v.index))
+		buf = binary.AppendUvarint(buf, v.cursor)
+		return binary.AppendUvarint(buf, uint64(v.large))
+	}
+	log.Panicf("unknown key queue item: %v", item)
+	return nil
+}
+
+func (scanQueueCodec) Decode(data []byte) interface{} {
+	switch data[0] {
+	case queueItemKey:
+		db, n := binary.Uvarint(data[1:])
+		return dbKey{db: int(db), key: string(data[1+n:])}
+	case queueItemPosition:
+		index, n := binary.Uvarint(data[1:])
+		cursor, m := binary.Uvarint(data[1+n:])
+		large, _ := binary.Uvarint(data[1+n+m:])
+		return scanPosition{index: int(index), cursor: cursor, large: int(large)}
+	}
+	log.Panicf("unknown key queue item type: %c", data[0])
+	return nil
+}
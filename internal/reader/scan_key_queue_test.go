@@ -0,0 +1,20 @@
+package reader
+
+import "testing"
+
+func TestScanQueueCodec(t *testing.T) {
+	items := []interface{}{
+		dbKey{db: 0, key: "key"},
+		dbKey{db: 15, key: ""},
+		dbKey{db: 300, key: "{user}\x00\xffbinary"},
+		scanPosition{},
+		scanPosition{index: 3, cursor: 1 << 63},
+		scanPosition{index: clusterSlots, cursor: 42, large: 7},
+	}
+	var codec scanQueueCodec
+	for _, item := range items {
+		if got := codec.Decode(codec.Encode(item)); got != item {
+			t.Errorf("decode(encode(%#v)) = %#v", item, got)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package reader
+
+import (
+	"RedisShake/internal/client"
+	"RedisShake/internal/client/proto"
+	"RedisShake/internal/log"
+	"RedisShake/internal/utils"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ksnRequiredClasses are the notify-keyspace-events classes needed to find
+// every change of the keys, "A" is an alias for all of them.
+const ksnRequiredClasses = "g$lshzxetd"
+
+const (
+	ksnMinBackoff = 1 * time.Second
+	ksnMaxBackoff = 30 * time.Second
+)
+
+var ksnDbRegex = regexp.MustCompile(`\d+`)
+
+// missingKSNFlags returns the flags to add to notify-keyspace-events so that
+// keyevent notifications of all the classes are enabled.
+func missingKSNFlags(flags string) string {
+	missing := ""
+	if !strings.Contains(flags, "E") {
+		missing += "E"
+	}
+	if strings.Contains(flags, "A") {
+		return missing
+	}
+	for _, class := range ksnRequiredClasses {
+		if !strings.ContainsRune(flags, class) {
+			return missing + "A"
+		}
+	}
+	return missing
+}
+
+// checkNotifyKeyspaceEvents makes sure the keyevent notifications are enabled
+// on the source, otherwise the changes are silently missed. Returns the
+// error if the connection is broken.
+func (r *scanStandaloneReader) checkNotifyKeyspaceEvents(c *client.Redis) error {
+	reply, err := c.TryDo("CONFIG", "GET", "notify-keyspace-events")
+	if _, ok := err.(proto.RedisError); ok {
+		log.Warnf("[%s] get notify-keyspace-events failed, make sure keyevent notifications of all the classes are enabled on the source. err=[%v]", r.stat.Name, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var flags string
+	switch v := reply.(type) {
+	case []interface{}: // RESP2
+		if len(v) == 2 {
+			flags, _ = v[1].(string)
+		}
+	case map[interface{}]interface{}: // RESP3
+		flags, _ = v["notify-keyspace-events"].(string)
+	}
+	missing := missingKSNFlags(flags)
+	if missing == "" {
+		return nil
+	}
+	if !r.opts.KSNSetConfig {
+		log.Panicf("[%s] notify-keyspace-events=[%s] misses [%s], changes of keys would be missed. Set it on the source, e.g. `CONFIG SET notify-keyspace-events AE`, or set ksn_set_config to true", r.stat.Name, flags, missing)
+	}
+	_, err = c.TryDo("CONFIG", "SET", "notify-keyspace-events", flags+missing)
+	if _, ok := err.(proto.RedisError); ok {
+		log.Panicf("[%s] set notify-keyspace-events failed. err=[%v]", r.stat.Name, err)
+	} else if err != nil {
+		return err
+	}
+	log.Infof("[%s] set notify-keyspace-events from [%s] to [%s]", r.stat.Name, flags, flags+missing)
+	return nil
+}
+
+// subscribeKSN subscribes to the keyevent notifications of all the dbs. It
+// tries again with backoff until the source is reachable and ready, e.g.
+// after a restart the source replies LOADING for a while.
+func (r *scanStandaloneReader) subscribeKSN() *client.Redis {
+	backoff := ksnMinBackoff
+	for {
+		c, err := r.trySubscribeKSN()
+		if err == nil {
+			return c
+		}
+		log.Warnf("[%s] subscribe keyspace notifications failed, try again after %v. err=[%v]", r.stat.Name, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > ksnMaxBackoff {
+			backoff = ksnMaxBackoff
+		}
+	}
+}
+
+func (r *scanStandaloneReader) trySubscribeKSN() (*client.Redis, error) {
+	c, err := client.DialRedisClient(r.opts.Address, r.opts.Username, r.opts.Password, r.opts.Tls, r.opts.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.checkNotifyKeyspaceEvents(c); err == nil {
+		// all the events, including del, expired, evicted, rename_from and
+		// move_from, after which the vanished key is deleted from the target
+		_, err = c.TryDo("psubscribe", "__keyevent@*__:*")
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *scanStandaloneReader) subscript() {
+	if !r.opts.KSN {
+		return
+	}
+	c := r.subscribeKSN()
+	go func() {
+		for {
+			err := r.receiveKSN(c)
+			c.Close()
+			lostSince := time.Now()
+			log.Warnf("[%s] keyspace notifications subscription dropped, subscribe again. err=[%v]", r.stat.Name, err)
+			c = r.subscribeKSN()
+			lostUntil := time.Now()
+			r.stat.KSNReconnectCount++
+			r.stat.KSNLostSince = lostSince.Format(time.RFC3339)
+			r.stat.KSNLostUntil = lostUntil.Format(time.RFC3339)
+			if r.opts.KSNRescan {
+				log.Warnf("[%s] changes between [%s] and [%s] may have been lost, scan the source again", r.stat.Name, r.stat.KSNLostSince, r.stat.KSNLostUntil)
+				go r.scan(scanPosition{}, true)
+			} else {
+				log.Warnf("[%s] changes between [%s] and [%s] may have been lost", r.stat.Name, r.stat.KSNLostSince, r.stat.KSNLostUntil)
+			}
+		}
+	}()
+}
+
+// receiveKSN puts the notified keys into the key queue until the
+// subscription is dropped.
+func (r *scanStandaloneReader) receiveKSN(c *client.Redis) error {
+	for {
+		resp, err := c.Receive()
+		if err != nil {
+			return err
+		}
+		msg, ok := resp.([]interface{})
+		if !ok || len(msg) != 4 {
+			continue
+		}
+		channel, _ := msg[2].(string)
+		key, _ := msg[3].(string)
+		dbId, err := strconv.Atoi(ksnDbRegex.FindString(channel))
+		if err != nil {
+			log.Panicf(err.Error())
+		}
+		if r.opts.Match != "" && !utils.MatchGlob(r.opts.Match, key) {
+			continue
+		}
+		r.keyQueue.Put(dbKey{db: dbId, key: key})
+	}
+}
@@ -0,0 +1,25 @@
+package reader
+
+import "testing"
+
+func TestMissingKSNFlags(t *testing.T) {
+	cases := []struct {
+		flags string
+		want  string
+	}{
+		{"", "EA"},
+		{"AE", ""},
+		{"KEA", ""},
+		{"Ex", "A"},
+		{"A", "E"},
+		{"Eg$lshzxetd", ""},
+		{"Eg$lshzxe", "A"},
+		{"g$lshzxetd", "E"},
+		{"KA", "E"},
+	}
+	for _, c := range cases {
+		if got := missingKSNFlags(c.flags); got != c.want {
+			t.Errorf("missingKSNFlags(%q) = %q, want %q", c.flags, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package reader
+
+import (
+	"RedisShake/internal/client"
+	"RedisShake/internal/commands"
+	"RedisShake/internal/config"
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const largeStringChunkBytes = 1024 * 1024
+
+const largeKeyTempPrefix = "__redis_shake_large_key__:"
+
+// renameLargeKeyScript renames KEYS[1] to KEYS[2], and replies BUSYKEY like
+// RESTORE if KEYS[2] exists and ARGV[1] is not "1".
+const renameLargeKeyScript = `if redis.call('EXISTS', KEYS[1]) == 0 then return 0 end
+if ARGV[1] ~= '1' and redis.call('EXISTS', KEYS[2]) == 1 then
+  redis.call('DEL', KEYS[1])
+  return redis.error_reply('BUSYKEY Target key name already exists.')
+end
+redis.call('RENAME', KEYS[1], KEYS[2])
+return 1`
+
+// countCommands returns the number of elements of the aggregate types.
+var countCommands = map[string]string{
+	"hash":   "HLEN",
+	"set":    "SCARD",
+	"zset":   "ZCARD",
+	"list":   "LLEN",
+	"stream": "XLEN",
+}
+
+func (r *scanStandaloneReader) largeKeyEnabled() bool {
+	return r.opts.LargeKeyBytes > 0 || r.opts.LargeKeyElements > 0
+}
+
+func (r *scanStandaloneReader) selectDb(c *client.Redis, nowDbId int, dbId int) int {
+	if nowDbId != dbId {
+		reply := c.DoWithStringReply("SELECT", strconv.Itoa(dbId))
+		if reply != "OK" {
+			log.Panicf("scanStandaloneReader select db failed. db=[%d]", dbId)
+		}
+	}
+	return dbId
+}
+
+// copyLargeKeys copies the large keys of the batch incrementally, and returns
+// the other keys to be read with DUMP and the db selected on the connection.
+func (r *scanStandaloneReader) copyLargeKeys(c *client.Redis, nowDbId int, batch []fetchedKey) ([]fetchedKey, int) {
+	small := make([]fetchedKey, 0, len(batch))
+	for start := 0; start < len(batch); {
+		// keys of the same db in a round trip
+		end := start + 1
+		for end < len(batch) && batch[end].db == batch[start].db {
+			end++
+		}
+		nowDbId = r.selectDb(c, nowDbId, batch[start].db)
+		run := batch[start:end]
+		for _, k := range run {
+			c.Send("TYPE", k.key)
+			if r.opts.LargeKeyBytes > 0 {
+				c.Send("MEMORY", "USAGE", k.key)
+			}
+		}
+		types := make([]string, len(run))
+		large := make([]bool, len(run))
+		for i := range run {
+			typ, err := client.String(c.Receive())
+			if err != nil {
+				log.Panicf("[%s] get type of key failed. key=[%s], err=[%v]", r.stat.Name, run[i].key, err)
+			}
+			types[i] = typ
+			if r.opts.LargeKeyBytes > 0 {
+				reply, err := c.Receive()
+				if size, ok := reply.(int64); err == nil && ok && size > int64(r.opts.LargeKeyBytes) {
+					large[i] = true
+				}
+			}
+		}
+		if r.opts.LargeKeyElements > 0 {
+			for i, k := range run {
+				if cmd, ok := countCommands[types[i]]; ok && !large[i] {
+					c.Send(cmd, k.key)
+				}
+			}
+			for i := range run {
+				if _, ok := countCommands[types[i]]; ok && !large[i] {
+					reply, err := c.Receive()
+					if count, ok := reply.(int64); err == nil && ok && count > int64(r.opts.LargeKeyElements) {
+						large[i] = true
+					}
+				}
+			}
+		}
+		for i, k := range run {
+			if r.opts.KeyType != "" && types[i] != "none" && types[i] != r.opts.KeyType {
+				continue // notified by KSN, but not of the type
+			}
+			if large[i] && (types[i] == "string" || countCommands[types[i]] != "") && canCopyLargeKey(k.key, r.opts.KeysPrefixed) {
+				r.copyLargeKey(c, k.db, k.key, types[i])
+			} else {
+				small = append(small, fetchedKey{dbKey: k.dbKey})
+			}
+		}
+		start = end
+	}
+	return small, nowDbId
+}
+
+// copyLargeKey copies the key chunk by chunk with native commands instead of
+// DUMP, which blocks the source for a long time on a huge key. The copy is
+// not atomic, the changes of the key during the copy may be lost. The chunks
+// are written to a temporary key, which is renamed to the key at last
+// according to rdb_restore_command_behavior like RESTORE.
+func (r *scanStandaloneReader) copyLargeKey(c *client.Redis, dbId int, key string, typ string) {
+	log.Infof("[%s] copy large key incrementally. db=[%d], key=[%s], type=[%s]", r.stat.Name, dbId, key, typ)
+	atomic.AddInt64(&r.stat.LargeKeyCount, 1)
+	send := func(argv ...string) {
+		r.ch <- &entry.Entry{DbId: dbId, Argv: argv}
+	}
+	tmp := largeKeyTemp(key)
+	send("DEL", tmp) // left by the last run
+	chunk := strconv.Itoa(r.opts.LargeKeyChunkSize)
+	switch typ {
+	case "string":
+		for offset := 0; ; offset += largeStringChunkBytes {
+			r.throttle.waitDelay()
+			value := c.DoWithStringReply("GETRANGE", key, strconv.Itoa(offset), strconv.Itoa(offset+largeStringChunkBytes-1))
+			if value == "" {
+				break
+			}
+			if offset == 0 {
+				send("SET", tmp, value)
+			} else {
+				send("APPEND", tmp, value)
+			}
+			r.throttle.waitBytes(len(value))
+		}
+	case "hash", "set", "zset":
+		scanCmd := map[string]string{"hash": "HSCAN", "set": "SSCAN", "zset": "ZSCAN"}[typ]
+		cursor := "0"
+		for {
+			r.throttle.waitDelay()
+			reply := c.Do(scanCmd, key, cursor, "COUNT", chunk).([]interface{})
+			cursor = fmt.Sprint(reply[0])
+			items := reply[1].([]interface{})
+			r.throttle.waitKeys(len(items))
+			if len(items) > 0 {
+				var argv []string
+				switch typ {
+				case "hash":
+					argv = []string{"HSET", tmp}
+					for _, item := range items {
+						argv = append(argv, fmt.Sprint(item))
+					}
+				case "set":
+					argv = []string{"SADD", tmp}
+					for _, item := range items {
+						argv = append(argv, fmt.Sprint(item))
+					}
+				case "zset":
+					argv = []string{"ZADD", tmp}
+					for i := 0; i+1 < len(items); i += 2 { // member, score
+						argv = append(argv, fmt.Sprint(items[i+1]), fmt.Sprint(items[i]))
+					}
+				}
+				send(argv...)
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+	case "list":
+		step := r.opts.LargeKeyChunkSize
+		for start := 0; ; start += step {
+			r.throttle.waitDelay()
+			items := c.Do("LRANGE", key, strconv.Itoa(start), strconv.Itoa(start+step-1)).([]interface{})
+			if len(items) == 0 {
+				break
+			}
+			argv := []string{"RPUSH", tmp}
+			for _, item := range items {
+				argv = append(argv, fmt.Sprint(item))
+			}
+			send(argv...)
+		}
+	case "stream":
+		start := "-"
+		for {
+			r.throttle.waitDelay()
+			items := c.Do("XRANGE", key, start, "+", "COUNT", chunk).([]interface{})
+			if len(items) == 0 {
+				break
+			}
+			var lastId string
+			for _, item := range items {
+				fields := item.([]interface{})
+				lastId = fmt.Sprint(fields[0])
+				argv := []string{"XADD", tmp, lastId}
+				for _, field := range fields[1].([]interface{}) {
+					argv = append(argv, fmt.Sprint(field))
+				}
+				send(argv...)
+			}
+			start = nextStreamId(lastId)
+		}
+	}
+
+	// apply the TTL after the copy
+	pttl, ok := c.Do("PTTL", key).(int64)
+	if !ok {
+		log.Panicf("[%s] unexpected PTTL reply. key=[%s]", r.stat.Name, key)
+	}
+	if pttl == -2 {
+		send("DEL", tmp)
+		r.deleteVanishedKey(dbId, key)
+		return
+	}
+	if pttl > 0 {
+		send("PEXPIRE", tmp, strconv.FormatInt(pttl, 10))
+	}
+	replace := "0"
+	if config.Opt.Advanced.RDBRestoreCommandBehavior == "rewrite" {
+		replace = "1"
+	}
+	send("EVAL", renameLargeKeyScript, "2", tmp, key, replace)
+}
+
+// largeKeyTemp returns the key on the target that a large key is copied to
+// before it is renamed, it is in the same slot as the key.
+func largeKeyTemp(key string) string {
+	return "{" + hashTag(key) + "}" + largeKeyTempPrefix + key
+}
+
+// hashTag returns the part of the key that decides its cluster slot.
+func hashTag(key string) string {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			return key[i+1 : i+1+j]
+		}
+	}
+	return key
+}
+
+// nextStreamId returns the smallest id greater than id, e.g. "1-1" -> "1-2".
+func nextStreamId(id string) string {
+	ms, seq, _ := strings.Cut(id, "-")
+	s, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		log.Panicf("invalid stream id: [%s]", id)
+	}
+	if s == ^uint64(0) {
+		m, err := strconv.ParseUint(ms, 10, 64)
+		if err != nil {
+			log.Panicf("invalid stream id: [%s]", id)
+		}
+		return strconv.FormatUint(m+1, 10) + "-0"
+	}
+	return ms + "-" + strconv.FormatUint(s+1, 10)
+}
+
+// canCopyLargeKey returns false if the temporary key can not be put in the
+// same slot as the key, e.g. "a}b", which is read with DUMP instead. If the
+// keys are prefixed on the way to the target, the key needs a hash tag, so
+// that the prefixed keys are in the same slot too. The prefix has no '{', so
+// any prefix gives the same result.
+func canCopyLargeKey(key string, prefixed bool) bool {
+	prefix := ""
+	if prefixed {
+		prefix = "p:"
+	}
+	slots := commands.CalcSlots([]string{key, largeKeyTemp(key), prefix + key, prefix + largeKeyTemp(key)})
+	return slots[0] == slots[1] && slots[2] == slots[3]
+}
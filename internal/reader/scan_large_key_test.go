@@ -0,0 +1,61 @@
+package reader
+
+import "testing"
+
+func TestNextStreamId(t *testing.T) {
+	cases := []struct {
+		id   string
+		want string
+	}{
+		{"0-0", "0-1"},
+		{"1-1", "1-2"},
+		{"1526919030474-9", "1526919030474-10"},
+		{"5-18446744073709551615", "6-0"},
+	}
+	for _, c := range cases {
+		if got := nextStreamId(c.id); got != c.want {
+			t.Errorf("nextStreamId(%q) = %q, want %q", c.id, got, c.want)
+		}
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	cases := []struct {
+		key  string
+		want string
+	}{
+		{"key", "key"},
+		{"{user}a", "user"},
+		{"a{user}b{c}", "user"},
+		{"{}a", "{}a"},
+		{"a{b", "a{b"},
+		{"a}b", "a}b"},
+		{"a{{b}}", "{b"},
+	}
+	for _, c := range cases {
+		if got := hashTag(c.key); got != c.want {
+			t.Errorf("hashTag(%q) = %q, want %q", c.key, got, c.want)
+		}
+	}
+}
+
+func TestCanCopyLargeKey(t *testing.T) {
+	cases := []struct {
+		key      string
+		prefixed bool
+		want     bool
+	}{
+		{"key", false, true},
+		{"{user}a", false, true},
+		{"a}b", false, false},
+		{"{}a", false, false},
+		// a prefixed key without hash tag is in another slot than the prefixed temporary key
+		{"key", true, false},
+		{"{user}a", true, true},
+	}
+	for _, c := range cases {
+		if got := canCopyLargeKey(c.key, c.prefixed); got != c.want {
+			t.Errorf("canCopyLargeKey(%q, %v) = %v, want %v", c.key, c.prefixed, got, c.want)
+		}
+	}
+}
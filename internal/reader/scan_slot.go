@@ -0,0 +1,170 @@
+package reader
+
+import (
+	"RedisShake/internal/client"
+	"RedisShake/internal/commands"
+	"RedisShake/internal/log"
+	"RedisShake/internal/utils"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const clusterSlots = 16384
+
+// parseSlotRanges parses slot ranges like "0-8191,10000", empty means all.
+func parseSlotRanges(ranges string) []bool {
+	selected := make([]bool, clusterSlots)
+	if strings.TrimSpace(ranges) == "" {
+		for i := range selected {
+			selected[i] = true
+		}
+		return selected
+	}
+	for _, part := range strings.Split(ranges, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+		start, err1 := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		end, err2 := start, error(nil)
+		if len(bounds) == 2 {
+			end, err2 = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		}
+		if err1 != nil || err2 != nil || start < 0 || end >= clusterSlots || start > end {
+			log.Panicf("invalid slots: [%s], must be like \"0-8191,10000\"", ranges)
+		}
+		for slot := start; slot <= end; slot++ {
+			selected[slot] = true
+		}
+	}
+	return selected
+}
+
+// initSlots sets the slots to scan, the selected slots served by the node.
+func (r *scanStandaloneReader) initSlots(opts *ScanReaderOptions, c *client.Redis) {
+	if !c.IsCluster() {
+		log.Panicf("[%s] slot_mode requires the source to be a redis cluster", r.stat.Name)
+	}
+	selected := parseSlotRanges(opts.Slots)
+	if opts.nodeSlots == nil { // a cluster node scanned as standalone, the slots not served have no keys
+		for slot := 0; slot < clusterSlots; slot++ {
+			if selected[slot] {
+				r.slots = append(r.slots, slot)
+			}
+		}
+	} else {
+		for _, slot := range opts.nodeSlots {
+			if selected[slot] {
+				r.slots = append(r.slots, slot)
+			}
+		}
+	}
+	sort.Ints(r.slots) // the checkpoint is the slot to continue from
+	r.stat.ScanSlotsTotal = len(r.slots)
+	log.Infof("[%s] scan %d slots", r.stat.Name, len(r.slots))
+}
+
+// scanSlots gets the keys slot by slot with CLUSTER GETKEYSINSLOT. The
+// slots with more than count keys are not got in one reply, their keys are
+// got by SCAN of the node after the other slots.
+func (r *scanStandaloneReader) scanSlots(c *client.Redis, from scanPosition) {
+	if from == (scanPosition{}) {
+		r.setLargeSlots(nil)
+	}
+	lastCheckpoint := time.Now()
+	for index := sort.SearchInts(r.slots, from.index); index < len(r.slots); index++ {
+		slot := strconv.Itoa(r.slots[index])
+		r.throttle.waitDelay()
+		c.Send("CLUSTER", "COUNTKEYSINSLOT", slot)
+		reply, err := c.Receive()
+		if err != nil {
+			log.Panicf("[%s] count keys in slot failed. slot=[%s], err=[%v]", r.stat.Name, slot, err)
+		}
+		if count := reply.(int64); count > int64(r.opts.Count) {
+			r.setLargeSlots(append(r.getLargeSlots(), r.slots[index]))
+		} else if count > 0 {
+			keys := client.ArrayString(c.Do("CLUSTER", "GETKEYSINSLOT", slot, strconv.FormatInt(count, 10)), nil)
+			for _, key := range keys {
+				if r.opts.Match != "" && !utils.MatchGlob(r.opts.Match, key) {
+					continue
+				}
+				r.keyQueue.Put(dbKey{0, key})
+			}
+		}
+
+		// stat
+		r.stat.ScanSlot = r.slots[index]
+		r.stat.ScanSlotsDone = index + 1
+		r.stat.ScanPercentByDbId = fmt.Sprintf("%.2f%%", float64(index+1)/float64(len(r.slots))*100)
+
+		if r.checkpointing() && (index+1 == len(r.slots) || time.Since(lastCheckpoint) >= scanCheckpointInterval) {
+			lastCheckpoint = time.Now()
+			next := clusterSlots
+			if index+1 < len(r.slots) {
+				next = r.slots[index+1]
+			}
+			r.keyQueue.Put(scanPosition{index: next, large: len(r.getLargeSlots())})
+		}
+	}
+	r.scanLargeSlots(c, from)
+}
+
+// scanLargeSlots gets the keys of the slots with more than count keys by
+// SCAN of the node, count keys in a reply.
+func (r *scanStandaloneReader) scanLargeSlots(c *client.Redis, from scanPosition) {
+	largeSlots := r.getLargeSlots()
+	if len(largeSlots) == 0 {
+		return
+	}
+	log.Infof("[%s] scan %d slots with more than %d keys by SCAN", r.stat.Name, len(largeSlots), r.opts.Count)
+	selected := make(map[int]bool, len(largeSlots))
+	for _, slot := range largeSlots {
+		selected[slot] = true
+	}
+	var cursor uint64
+	if from.index == clusterSlots {
+		cursor = from.cursor
+	}
+	lastCheckpoint := time.Now()
+	for {
+		var keys []string
+		r.throttle.waitDelay()
+		cursor, keys = c.Scan(cursor, r.opts.Match, r.opts.Count, r.opts.KeyType)
+		slots := commands.CalcSlots(keys)
+		for i, key := range keys {
+			if selected[slots[i]] {
+				r.keyQueue.Put(dbKey{0, key})
+			}
+		}
+
+		// stat
+		r.stat.ScanCursor = cursor
+		r.stat.ScanPercentByDbId = fmt.Sprintf("%.2f%%", float64(bits.Reverse64(cursor))/float64(^uint(0))*100)
+
+		if r.checkpointing() && cursor != 0 && time.Since(lastCheckpoint) >= scanCheckpointInterval {
+			lastCheckpoint = time.Now()
+			r.keyQueue.Put(scanPosition{index: clusterSlots, cursor: cursor, large: len(largeSlots)})
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if r.checkpointing() {
+		r.keyQueue.Put(scanPosition{index: clusterSlots}) // no large slots left
+	}
+}
+
+func (r *scanStandaloneReader) getLargeSlots() []int {
+	r.largeSlotsLock.Lock()
+	defer r.largeSlotsLock.Unlock()
+	return r.largeSlots
+}
+
+func (r *scanStandaloneReader) setLargeSlots(slots []int) {
+	r.largeSlotsLock.Lock()
+	defer r.largeSlotsLock.Unlock()
+	r.largeSlots = slots
+	r.stat.ScanLargeSlots = len(slots)
+}
@@ -0,0 +1,98 @@
+package reader
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSlotRanges(t *testing.T) {
+	cases := []struct {
+		ranges string
+		want   []int // selected slots, nil means all
+	}{
+		{"", nil},
+		{" ", nil},
+		{"0", []int{0}},
+		{"16383", []int{16383}},
+		{"0-2", []int{0, 1, 2}},
+		{"0-1, 5 ,10 - 11", []int{0, 1, 5, 10, 11}},
+		{"3-3,1-2", []int{1, 2, 3}},
+	}
+	for _, c := range cases {
+		selected := parseSlotRanges(c.ranges)
+		if len(selected) != clusterSlots {
+			t.Fatalf("parseSlotRanges(%q) returns %d slots, want %d", c.ranges, len(selected), clusterSlots)
+		}
+		var got []int
+		for slot, ok := range selected {
+			if ok {
+				got = append(got, slot)
+			}
+		}
+		if c.want == nil {
+			if len(got) != clusterSlots {
+				t.Errorf("parseSlotRanges(%q) selects %d slots, want all", c.ranges, len(got))
+			}
+		} else if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseSlotRanges(%q) = %v, want %v", c.ranges, got, c.want)
+		}
+	}
+}
+
+func TestLoadSlotCheckpoint(t *testing.T) {
+	cases := []struct {
+		name       string
+		slots      []int // slots to scan by this run
+		cp         scanCheckpoint
+		want       scanPosition
+		largeSlots []int
+	}{
+		{
+			name:       "resume",
+			slots:      []int{1, 2, 3, 4},
+			cp:         scanCheckpoint{Slots: []int{1, 2, 3, 4}, Slot: 3, LargeSlots: []int{2}},
+			want:       scanPosition{index: 3, large: 1},
+			largeSlots: []int{2},
+		},
+		{
+			name:  "slots after the saved slot are added",
+			slots: []int{1, 2, 3, 4, 5},
+			cp:    scanCheckpoint{Slots: []int{1, 2, 3}, Slot: 3},
+			want:  scanPosition{index: 3},
+		},
+		{
+			name:  "slot before the saved slot is not scanned",
+			slots: []int{0, 1, 2, 3},
+			cp:    scanCheckpoint{Slots: []int{1, 2, 3}, Slot: 3, LargeSlots: []int{2}},
+			want:  scanPosition{},
+		},
+		{
+			name:       "large slots not served any more are dropped",
+			slots:      []int{1, 2},
+			cp:         scanCheckpoint{Slots: []int{1, 2, 3}, Slot: clusterSlots, LargeSlots: []int{2, 3}, Cursor: 42},
+			want:       scanPosition{index: clusterSlots, cursor: 42, large: 1},
+			largeSlots: []int{2},
+		},
+		{
+			name:  "finished",
+			slots: []int{1, 2},
+			cp:    scanCheckpoint{Slots: []int{1, 2}, Slot: clusterSlots},
+			want:  scanPosition{index: clusterSlots},
+		},
+		{
+			name:  "invalid slot",
+			slots: []int{1, 2},
+			cp:    scanCheckpoint{Slots: []int{1, 2}, Slot: -1},
+			want:  scanPosition{},
+		},
+	}
+	for _, c := range cases {
+		r := &scanStandaloneReader{slots: c.slots, opts: &ScanReaderOptions{SlotMode: true}}
+		if got := r.loadSlotCheckpoint(c.cp, "checkpoint.json"); got != c.want {
+			t.Errorf("%s: position = %+v, want %+v", c.name, got, c.want)
+		}
+		if got := r.getLargeSlots(); len(got) != len(c.largeSlots) || (len(got) > 0 && !reflect.DeepEqual(got, c.largeSlots)) {
+			t.Errorf("%s: large slots = %v, want %v", c.name, got, c.largeSlots)
+		}
+	}
+}
@@ -2,17 +2,17 @@ package reader
 
 import (
 	"RedisShake/internal/client"
-	"RedisShake/internal/client/proto"
-	"RedisShake/internal/config"
 	"RedisShake/internal/entry"
 	"RedisShake/internal/log"
 	"RedisShake/internal/rdb/types"
 	"RedisShake/internal/utils"
 	"fmt"
 	"math/bits"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ScanReaderOptions struct {
@@ -21,8 +21,64 @@ type ScanReaderOptions struct {
 	Username string `mapstructure:"username" default:""`
 	Password string `mapstructure:"password" default:""`
 	Tls      bool   `mapstructure:"tls" default:"false"`
+	Protocol int    `mapstructure:"protocol" default:"2"` // RESP version, 2 or 3
 	KSN      bool   `mapstructure:"ksn" default:"false"`
-	DBS      []int  `mapstructure:"dbs"`
+	// Add the missing flags to notify-keyspace-events of the source by CONFIG SET
+	// in KSN mode, otherwise redis-shake stops if they are missing.
+	KSNSetConfig bool `mapstructure:"ksn_set_config" default:"false"`
+	// Scan the source again after the subscription is dropped and reconnected,
+	// the changes in between are lost otherwise.
+	KSNRescan bool  `mapstructure:"ksn_rescan" default:"false"`
+	DBS       []int `mapstructure:"dbs"`
+	// Only the keys matching the glob-style pattern and of the type (string,
+	// list, set, zset, hash or stream) are synced, keep empty to sync all the
+	// keys. They are pushed down to SCAN as MATCH and TYPE, key_type requires
+	// Redis 6.0+. count is the COUNT of SCAN.
+	Match    string `mapstructure:"match" default:""`
+	KeyType  string `mapstructure:"key_type" default:""`
+	Count    int    `mapstructure:"count" default:"2048"`
+	LoadMode string `mapstructure:"load_mode" default:"restore"` // restore or rewrite
+	// Keys are fetched by fetch_concurrency connections, each sends DUMP and
+	// PTTL of up to fetch_batch_size keys in a round trip. Keys are partitioned
+	// by hash, so the changes of a key are applied in order.
+	FetchConcurrency int `mapstructure:"fetch_concurrency" default:"1"`
+	FetchBatchSize   int `mapstructure:"fetch_batch_size" default:"32"`
+	// Save the scan position to dir/checkpoint after the keys scanned before it
+	// are written to the target, and resume from it when restarted.
+	Checkpoint bool `mapstructure:"checkpoint" default:"false"`
+	// Get the keys of a cluster slot by slot with CLUSTER GETKEYSINSLOT instead
+	// of SCAN, only the slots in slots are synced, e.g. "0-8191,10000". Keep
+	// slots empty to sync all the slots.
+	SlotMode bool   `mapstructure:"slot_mode" default:"false"`
+	Slots    string `mapstructure:"slots" default:""`
+
+	// Protect the source from the load of scanning. Keys and bytes read from the
+	// source are limited per second, 0 means no limit. Every round trip to the
+	// source is delayed while the latency of PING exceeds max_source_latency
+	// milliseconds or instantaneous_ops_per_sec exceeds max_source_ops_per_second,
+	// 0 means no threshold.
+	MaxKeysPerSecond      int `mapstructure:"max_keys_per_second" default:"0"`
+	MaxBytesPerSecond     int `mapstructure:"max_bytes_per_second" default:"0"`
+	MaxSourceLatency      int `mapstructure:"max_source_latency" default:"0"`
+	MaxSourceOpsPerSecond int `mapstructure:"max_source_ops_per_second" default:"0"`
+
+	// Keys waiting to be fetched are kept in memory up to key_queue_size, the
+	// others are spilled to dir.
+	KeyQueueSize int `mapstructure:"key_queue_size" default:"100000"`
+
+	// Keys larger than large_key_bytes by MEMORY USAGE or with more elements
+	// than large_key_elements are copied by HSCAN, SSCAN, ZSCAN, LRANGE, XRANGE
+	// or GETRANGE in chunks of large_key_chunk_size elements instead of DUMP,
+	// 0 means no threshold. The copy of a large key is not atomic.
+	LargeKeyBytes     int `mapstructure:"large_key_bytes" default:"0"`
+	LargeKeyElements  int `mapstructure:"large_key_elements" default:"0"`
+	LargeKeyChunkSize int `mapstructure:"large_key_chunk_size" default:"1000"`
+
+	// Keys are prefixed on the way to the target, by fold_db of the writer or
+	// key_prefix of merge_reader. Set by the caller, not by the config.
+	KeysPrefixed bool `mapstructure:"-"`
+
+	nodeSlots []int // slots served by the node, set by scanClusterReader
 }
 
 type dbKey struct {
@@ -31,10 +87,20 @@ type dbKey struct {
 }
 
 type scanStandaloneReader struct {
-	dbs      []int
-	opts     *ScanReaderOptions
-	ch       chan *entry.Entry
-	keyQueue *utils.UniqueQueue
+	dbs   []int
+	slots []int // in slot mode
+	// slots with more than count keys in slot mode, scanned by SCAN at last
+	largeSlots     []int
+	largeSlotsLock sync.Mutex
+	opts           *ScanReaderOptions
+	ch             chan *entry.Entry
+	keyQueue       *utils.SpillQueue
+	scanLock       sync.Mutex
+	// scanning again after the KSN subscription is dropped, the positions of
+	// the rescan are not checkpointed to keep the finished one. Guarded by
+	// scanLock.
+	rescanning bool
+	throttle   *scanThrottle
 
 	stat struct {
 		Name              string `json:"name"`
@@ -42,14 +108,33 @@ type scanStandaloneReader struct {
 		ScanDbId          int    `json:"scan_dbId"`
 		ScanCursor        uint64 `json:"scan_cursor"`
 		ScanPercentByDbId string `json:"scan_percent"`
+		ScanSlot          int    `json:"scan_slot"` // in slot mode
+		ScanSlotsDone     int    `json:"scan_slots_done"`
+		ScanSlotsTotal    int    `json:"scan_slots_total"`
+		ScanLargeSlots    int    `json:"scan_large_slots"` // slots with more than count keys, scanned by SCAN at last
 		NeedUpdateCount   int64  `json:"need_update_count"`
+		SpilledCount      int64  `json:"spilled_count"`   // keys in need_update_count spilled to disk
+		DeletedCount      int64  `json:"deleted_count"`   // keys vanished on the source and deleted from the target in KSN mode
+		LargeKeyCount     int64  `json:"large_key_count"` // keys copied incrementally
+
+		// the changes between ksn_lost_since and ksn_lost_until may have been
+		// lost because the subscription was dropped
+		KSNReconnectCount int64  `json:"ksn_reconnect_count"`
+		KSNLostSince      string `json:"ksn_lost_since"`
+		KSNLostUntil      string `json:"ksn_lost_until"`
+
+		// source load protection
+		SourceLatencyUs    int64 `json:"source_latency_us"`
+		SourceOpsPerSecond int64 `json:"source_ops_per_second"`
+		ThrottleDelayMs    int64 `json:"throttle_delay_ms"` // delay of every round trip to the source
 	}
 }
 
 func NewScanStandaloneReader(opts *ScanReaderOptions) Reader {
+	types.CheckLoadMode(opts.LoadMode)
 	r := new(scanStandaloneReader)
 	// dbs
-	c := client.NewRedisClient(opts.Address, opts.Username, opts.Password, opts.Tls)
+	c := client.NewRedisClientWithProtocol(opts.Address, opts.Username, opts.Password, opts.Tls, opts.Protocol)
 	if c.IsCluster() { // not use opts.Cluster, because user may use standalone mode to scan a cluster node
 		r.dbs = []int{0}
 	} else {
@@ -59,52 +144,61 @@ func NewScanStandaloneReader(opts *ScanReaderOptions) Reader {
 			r.dbs = opts.DBS
 		}
 	}
+	if opts.Count < 1 {
+		log.Panicf("invalid scan count: [%d], must be positive", opts.Count)
+	}
+	opts.KeyType = strings.ToLower(opts.KeyType)
 	r.opts = opts
 	r.ch = make(chan *entry.Entry, 1024)
 	r.stat.Name = "reader_" + strings.Replace(opts.Address, ":", "_", -1)
-	r.keyQueue = utils.NewUniqueQueue(100000) // cache 100000 keys
+	if opts.SlotMode {
+		r.initSlots(opts, c)
+	}
+	if opts.LargeKeyChunkSize < 1 {
+		log.Panicf("invalid large_key_chunk_size: [%d], must be positive", opts.LargeKeyChunkSize)
+	}
+	if opts.KeyQueueSize < 1 {
+		log.Panicf("invalid key_queue_size: [%d], must be positive", opts.KeyQueueSize)
+	}
+	// keys more than key_queue_size are spilled to disk, so that KSN never blocks
+	r.keyQueue = utils.NewSpillQueue(opts.KeyQueueSize, utils.GetAbsPath(r.stat.Name+"_key_queue.spill"), scanQueueCodec{})
 	return r
 }
 
 func (r *scanStandaloneReader) StartRead() chan *entry.Entry {
+	r.throttle = r.newScanThrottle()
 	r.subscript()
-	go r.scan()
+	from := scanPosition{}
+	if r.opts.Checkpoint {
+		from = r.loadCheckpoint()
+	}
+	go r.scan(from, false)
 	go r.fetch()
 	return r.ch
 }
 
-func (r *scanStandaloneReader) subscript() {
+func (r *scanStandaloneReader) scan(from scanPosition, rescan bool) {
+	r.scanLock.Lock() // scan again after the KSN subscription is dropped
+	defer r.scanLock.Unlock()
+	r.rescanning = rescan
+	r.stat.ScanFinished = false
+	c := client.NewRedisClientWithProtocol(r.opts.Address, r.opts.Username, r.opts.Password, r.opts.Tls, r.opts.Protocol)
+	defer c.Close()
+	if r.opts.SlotMode {
+		r.scanSlots(c, from)
+	} else {
+		r.scanDbs(c, from)
+	}
+	r.stat.ScanFinished = true
 	if !r.opts.KSN {
-		return
+		r.keyQueue.Close()
 	}
-	c := client.NewRedisClient(r.opts.Address, r.opts.Username, r.opts.Password, r.opts.Tls)
-	c.Send("psubscribe", "__keyevent@*__:*")
-
-	go func() {
-		_, err := c.Receive()
-		if err != nil {
-			log.Panicf(err.Error())
-		}
-		regex := regexp.MustCompile(`\d+`)
-		for {
-			resp, err := c.Receive()
-			if err != nil {
-				log.Panicf(err.Error())
-			}
-			key := resp.([]interface{})[3].(string)
-			dbId := regex.FindString(resp.([]interface{})[2].(string))
-			dbIdInt, err := strconv.Atoi(dbId)
-			if err != nil {
-				log.Panicf(err.Error())
-			}
-			r.keyQueue.Put(dbKey{db: dbIdInt, key: key})
-		}
-	}()
 }
 
-func (r *scanStandaloneReader) scan() {
-	c := client.NewRedisClient(r.opts.Address, r.opts.Username, r.opts.Password, r.opts.Tls)
-	for _, dbId := range r.dbs {
+func (r *scanStandaloneReader) scanDbs(c *client.Redis, from scanPosition) {
+	lastCheckpoint := time.Now()
+	for dbIndex := from.index; dbIndex < len(r.dbs); dbIndex++ {
+		dbId := r.dbs[dbIndex]
 		if dbId != 0 {
 			reply := c.DoWithStringReply("SELECT", strconv.Itoa(dbId))
 			if reply != "OK" {
@@ -113,9 +207,13 @@ func (r *scanStandaloneReader) scan() {
 		}
 
 		var cursor uint64 = 0
+		if dbIndex == from.index {
+			cursor = from.cursor
+		}
 		for {
 			var keys []string
-			cursor, keys = c.Scan(cursor)
+			r.throttle.waitDelay()
+			cursor, keys = c.Scan(cursor, r.opts.Match, r.opts.Count, r.opts.KeyType)
 			for _, key := range keys {
 				r.keyQueue.Put(dbKey{dbId, key}) // pass value not pointer
 			}
@@ -125,83 +223,41 @@ func (r *scanStandaloneReader) scan() {
 			r.stat.ScanDbId = dbId
 			r.stat.ScanPercentByDbId = fmt.Sprintf("%.2f%%", float64(bits.Reverse64(cursor))/float64(^uint(0))*100)
 
+			if r.checkpointing() && (cursor == 0 || time.Since(lastCheckpoint) >= scanCheckpointInterval) {
+				lastCheckpoint = time.Now()
+				if cursor == 0 {
+					r.keyQueue.Put(scanPosition{index: dbIndex + 1})
+				} else {
+					r.keyQueue.Put(scanPosition{index: dbIndex, cursor: cursor})
+				}
+			}
 			if cursor == 0 {
 				break
 			}
 		}
 	}
-	r.stat.ScanFinished = true
-	if !r.opts.KSN {
-		r.keyQueue.Close()
-	}
 }
 
-func (r *scanStandaloneReader) fetch() {
-	nowDbId := 0
-	c := client.NewRedisClient(r.opts.Address, r.opts.Username, r.opts.Password, r.opts.Tls)
-	for item := range r.keyQueue.Ch {
-		r.stat.NeedUpdateCount = int64(r.keyQueue.Len())
-		dbId := item.(dbKey).db
-		key := item.(dbKey).key
-		if nowDbId != dbId {
-			reply := c.DoWithStringReply("SELECT", strconv.Itoa(dbId))
-			if reply != "OK" {
-				log.Panicf("scanStandaloneReader select db failed. db=[%d]", dbId)
-			}
-			nowDbId = dbId
-		}
-		// dump
-		c.Send("DUMP", key)
-		c.Send("PTTL", key)
-		iDump, err1 := c.Receive()
-		iPttl, err2 := c.Receive()
-		if err1 == proto.Nil {
-			continue // key not exist
-		} else if err1 != nil {
-			log.Panicf(err1.Error())
-		} else if err2 != nil {
-			log.Panicf(err2.Error())
-		}
-		dump := iDump.(string)
-		pttl := int(iPttl.(int64))
-		if pttl == -2 {
-			continue // key not exist
-		}
-		if pttl == -1 {
-			pttl = 0 // -1 means no expire
-		}
-		if uint64(len(dump)) > config.Opt.Advanced.TargetRedisProtoMaxBulkLen {
-			log.Warnf("key=[%s] dump len=[%d] too large, split it. This is not a good practice in Redis.", key, len(dump))
-			typeByte := dump[0]
-			anotherReader := strings.NewReader(dump[1 : len(dump)-10])
-			o := types.ParseObject(anotherReader, typeByte, key)
-			cmds := o.Rewrite()
-			for _, cmd := range cmds {
-				e := entry.NewEntry()
-				e.DbId = dbId
-				e.Argv = cmd
-				r.ch <- e
-			}
-			if pttl != 0 {
-				e := entry.NewEntry()
-				e.DbId = dbId
-				e.Argv = []string{"PEXPIRE", key, strconv.Itoa(pttl)}
-				r.ch <- e
-			}
-		} else {
-			argv := []string{"RESTORE", key, strconv.Itoa(pttl), dump}
-			if config.Opt.Advanced.RDBRestoreCommandBehavior == "rewrite" {
-				argv = append(argv, "replace")
-			}
-			r.ch <- &entry.Entry{
-				DbId: dbId,
-				Argv: argv,
-			}
-		}
-	}
+// checkpointing returns true if the scan positions are to be checkpointed,
+// called by the scan goroutine.
+func (r *scanStandaloneReader) checkpointing() bool {
+	return r.opts.Checkpoint && !r.rescanning
+}
 
-	log.Infof("[%s] scanStandaloneReader fetch finished.", r.stat.Name)
-	close(r.ch)
+// deleteVanishedKey deletes the key from the target in KSN mode. The key is
+// deleted, expired, evicted, renamed or moved on the source after it was
+// scanned or notified, e.g. by the del, expired, evicted, rename_from and
+// move_from events.
+func (r *scanStandaloneReader) deleteVanishedKey(dbId int, key string) {
+	if !r.opts.KSN {
+		return
+	}
+	log.Debugf("[%s] key not exist, delete it from target. db=[%d], key=[%s]", r.stat.Name, dbId, key)
+	atomic.AddInt64(&r.stat.DeletedCount, 1)
+	r.ch <- &entry.Entry{
+		DbId: dbId,
+		Argv: []string{"DEL", key},
+	}
 }
 
 func (r *scanStandaloneReader) Status() interface{} {
@@ -212,6 +268,12 @@ func (r *scanStandaloneReader) StatusString() string {
 	if r.stat.ScanFinished {
 		return fmt.Sprintf("need_update_count=[%d]", r.stat.NeedUpdateCount)
 	}
+	if r.stat.ThrottleDelayMs > 0 {
+		return fmt.Sprintf("scan_percent=[%s], throttle_delay=[%dms], need_update_count=[%d]", r.stat.ScanPercentByDbId, r.stat.ThrottleDelayMs, r.stat.NeedUpdateCount)
+	}
+	if r.opts.SlotMode {
+		return fmt.Sprintf("scan_slot=[%d], scan_slots=[%d/%d], need_update_count=[%d]", r.stat.ScanSlot, r.stat.ScanSlotsDone, r.stat.ScanSlotsTotal, r.stat.NeedUpdateCount)
+	}
 	return fmt.Sprintf("scan_dbid=[%d], scan_percent=[%s], need_update_count=[%d]", r.stat.ScanDbId, r.stat.ScanPercentByDbId, r.stat.NeedUpdateCount)
 }
 
@@ -0,0 +1,156 @@
+package reader
+
+import (
+	"RedisShake/internal/client"
+	"RedisShake/internal/log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	throttleInterval = 100 * time.Millisecond
+	maxThrottleDelay = 1 * time.Second
+)
+
+// rateLimiter is a token bucket allowing rate per second with a burst of one
+// second. Tokens can be borrowed, the borrower waits for them to be refilled.
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (l *rateLimiter) wait(n float64) {
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= n
+	tokens := l.tokens
+	l.lock.Unlock()
+	if tokens < 0 {
+		time.Sleep(time.Duration(-tokens / l.rate * float64(time.Second)))
+	}
+}
+
+// scanThrottle protects the source from the load of scanning and fetching.
+// Besides the fixed rate limits, it delays every round trip to the source when
+// the latency of PING or the ops of the source exceed the thresholds, doubling
+// the delay while they are exceeded and halving it otherwise.
+type scanThrottle struct {
+	keys  *rateLimiter // nil if not limited
+	bytes *rateLimiter
+
+	delay int64 // in nanoseconds
+}
+
+func (r *scanStandaloneReader) newScanThrottle() *scanThrottle {
+	t := new(scanThrottle)
+	if r.opts.MaxKeysPerSecond < 0 || r.opts.MaxBytesPerSecond < 0 || r.opts.MaxSourceLatency < 0 || r.opts.MaxSourceOpsPerSecond < 0 {
+		log.Panicf("[%s] invalid scan reader limits, must not be negative", r.stat.Name)
+	}
+	if r.opts.MaxKeysPerSecond > 0 {
+		t.keys = newRateLimiter(float64(r.opts.MaxKeysPerSecond))
+	}
+	if r.opts.MaxBytesPerSecond > 0 {
+		t.bytes = newRateLimiter(float64(r.opts.MaxBytesPerSecond))
+	}
+	if r.opts.MaxSourceLatency > 0 || r.opts.MaxSourceOpsPerSecond > 0 {
+		go r.monitorSource(t)
+	}
+	return t
+}
+
+// waitDelay is called before a round trip to the source.
+func (t *scanThrottle) waitDelay() {
+	if delay := atomic.LoadInt64(&t.delay); delay > 0 {
+		time.Sleep(time.Duration(delay))
+	}
+}
+
+// waitKeys is called before reading n keys from the source.
+func (t *scanThrottle) waitKeys(n int) {
+	t.waitDelay()
+	if t.keys != nil {
+		t.keys.wait(float64(n))
+	}
+}
+
+// waitBytes is called after n bytes are read from the source.
+func (t *scanThrottle) waitBytes(n int) {
+	if t.bytes != nil {
+		t.bytes.wait(float64(n))
+	}
+}
+
+func (t *scanThrottle) adjust(overloaded bool) time.Duration {
+	delay := time.Duration(atomic.LoadInt64(&t.delay))
+	if overloaded {
+		delay *= 2
+		if delay < time.Millisecond {
+			delay = time.Millisecond
+		}
+		if delay > maxThrottleDelay {
+			delay = maxThrottleDelay
+		}
+	} else {
+		delay /= 2
+		if delay < time.Millisecond {
+			delay = 0
+		}
+	}
+	atomic.StoreInt64(&t.delay, int64(delay))
+	return delay
+}
+
+// monitorSource measures the latency of PING and the ops of the source, and
+// adjusts the delay of the throttle.
+func (r *scanStandaloneReader) monitorSource(t *scanThrottle) {
+	c := client.NewRedisClientWithProtocol(r.opts.Address, r.opts.Username, r.opts.Password, r.opts.Tls, r.opts.Protocol)
+	defer c.Close()
+	maxLatency := time.Duration(r.opts.MaxSourceLatency) * time.Millisecond
+	var ops int64
+	ticks := 0
+	for range time.Tick(throttleInterval) {
+		start := time.Now()
+		c.Do("PING")
+		latency := time.Since(start)
+		if r.opts.MaxSourceOpsPerSecond > 0 && ticks%10 == 0 { // INFO once a second
+			ops = sourceOps(c)
+		}
+		ticks++
+
+		overloaded := (maxLatency > 0 && latency > maxLatency) ||
+			(r.opts.MaxSourceOpsPerSecond > 0 && ops > int64(r.opts.MaxSourceOpsPerSecond))
+		delay := t.adjust(overloaded)
+		atomic.StoreInt64(&r.stat.SourceLatencyUs, latency.Microseconds())
+		atomic.StoreInt64(&r.stat.SourceOpsPerSecond, ops)
+		atomic.StoreInt64(&r.stat.ThrottleDelayMs, delay.Milliseconds())
+	}
+}
+
+// sourceOps returns instantaneous_ops_per_sec in INFO stats.
+func sourceOps(c *client.Redis) int64 {
+	info, ok := c.Do("INFO", "stats").(string)
+	if !ok {
+		return 0
+	}
+	for _, line := range strings.Split(info, "\n") {
+		if strings.HasPrefix(line, "instantaneous_ops_per_sec:") {
+			ops, _ := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "instantaneous_ops_per_sec:")), 10, 64)
+			return ops
+		}
+	}
+	return 0
+}
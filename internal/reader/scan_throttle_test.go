@@ -0,0 +1,48 @@
+package reader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// tokens are refilled up to the burst of one second
+	l := &rateLimiter{rate: 1000, last: time.Now().Add(-time.Hour)}
+	start := time.Now()
+	l.wait(0)
+	if l.tokens != l.rate {
+		t.Fatalf("tokens = %v, want %v", l.tokens, l.rate)
+	}
+
+	// the burst is taken without waiting, borrowed tokens are waited for
+	l.wait(1000)
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Fatalf("burst waits %v", elapsed)
+	}
+	l.wait(50)
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("borrowing 50 tokens at 1000/s waits %v, want about 50ms", elapsed)
+	}
+}
+
+func TestScanThrottleAdjust(t *testing.T) {
+	cases := []struct {
+		delay      time.Duration
+		overloaded bool
+		want       time.Duration
+	}{
+		{0, false, 0},
+		{0, true, time.Millisecond},
+		{time.Millisecond, true, 2 * time.Millisecond},
+		{600 * time.Millisecond, true, maxThrottleDelay},
+		{maxThrottleDelay, true, maxThrottleDelay},
+		{8 * time.Millisecond, false, 4 * time.Millisecond},
+		{time.Millisecond, false, 0},
+	}
+	for _, c := range cases {
+		throttle := &scanThrottle{delay: int64(c.delay)}
+		if got := throttle.adjust(c.overloaded); got != c.want || time.Duration(throttle.delay) != c.want {
+			t.Errorf("adjust(%v) with delay %v = %v, want %v", c.overloaded, c.delay, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package reader
+
+import (
+	"RedisShake/internal/bidirectional"
+	"RedisShake/internal/config"
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loopFilter drops the transactions written by redis-shake on the other side
+// of a bidirectional sync, recognized by the marker PUBLISH following MULTI,
+// so that they are not sent back to where they came from.
+type loopFilter struct {
+	name string
+	out  chan *entry.Entry
+	hold *conflictHold // nil if conflict_window is 0
+
+	pendingMulti   *entry.Entry // MULTI waiting for the next command to tell if it is a marker transaction
+	inMarker       bool
+	markerPriority int
+
+	dropped int64
+}
+
+func newLoopFilter(name string, out chan *entry.Entry) *loopFilter {
+	f := &loopFilter{name: name, out: out}
+	opts := &config.Opt.Bidirectional
+	if opts.ConflictWindow < 0 {
+		log.Panicf("invalid bidirectional conflict_window: [%d], must not be negative", opts.ConflictWindow)
+	}
+	if opts.ConflictWindow > 0 {
+		f.hold = newConflictHold(time.Duration(opts.ConflictWindow)*time.Millisecond, out)
+	}
+	log.Infof("[%s] bidirectional sync, id=[%s], priority=[%d], conflict_window=[%dms]", name, opts.Id, opts.Priority, opts.ConflictWindow)
+	return f
+}
+
+func (f *loopFilter) send(e *entry.Entry) {
+	if f.inMarker {
+		if e.CmdName == "EXEC" || e.CmdName == "DISCARD" {
+			f.inMarker = false
+			return
+		}
+		atomic.AddInt64(&f.dropped, 1)
+		if f.hold != nil && f.markerPriority > config.Opt.Bidirectional.Priority {
+			f.hold.dropConflicts(e)
+		}
+		return
+	}
+	if id, priority, ok := bidirectional.ParseMarker(e.Argv); ok {
+		log.Debugf("[%s] drop the transaction written by [%s]", f.name, id)
+		if f.pendingMulti != nil {
+			f.pendingMulti = nil
+			f.inMarker = true
+			f.markerPriority = priority
+		}
+		return
+	}
+	if f.pendingMulti != nil {
+		f.emit(f.pendingMulti)
+		f.pendingMulti = nil
+	}
+	if e.CmdName == "MULTI" {
+		f.pendingMulti = e
+		return
+	}
+	f.emit(e)
+}
+
+func (f *loopFilter) emit(e *entry.Entry) {
+	if f.hold != nil {
+		f.hold.push(e)
+		return
+	}
+	f.out <- e
+}
+
+func (f *loopFilter) isEmpty() bool {
+	return f.pendingMulti == nil && (f.hold == nil || f.hold.isEmpty())
+}
+
+type heldEntry struct {
+	e     *entry.Entry
+	until time.Time
+}
+
+// conflictHold holds the writes of the source for the conflict window. A held
+// write is dropped if a key of it is written by a higher priority side in the
+// meantime, so that both sides end up with the value of the higher priority
+// side.
+type conflictHold struct {
+	lock    sync.Mutex
+	entries []heldEntry
+	window  time.Duration
+	dropped int64
+}
+
+func newConflictHold(window time.Duration, out chan *entry.Entry) *conflictHold {
+	h := &conflictHold{window: window}
+	go h.flush(out)
+	return h
+}
+
+func (h *conflictHold) push(e *entry.Entry) {
+	h.lock.Lock()
+	h.entries = append(h.entries, heldEntry{e: e, until: time.Now().Add(h.window)})
+	h.lock.Unlock()
+}
+
+// dropConflicts drops the held entries writing any key of e.
+func (h *conflictHold) dropConflicts(e *entry.Entry) {
+	if len(e.Keys) == 0 {
+		return
+	}
+	keys := make(map[string]bool, len(e.Keys))
+	for _, key := range e.Keys {
+		keys[key] = true
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	kept := h.entries[:0]
+	for _, held := range h.entries {
+		if held.e.DbId == e.DbId && hasAnyKey(held.e, keys) {
+			log.Infof("conflict with a write from the higher priority side, drop it. cmd=[%s]", held.e.String())
+			h.dropped++
+			continue
+		}
+		kept = append(kept, held)
+	}
+	h.entries = kept
+}
+
+func hasAnyKey(e *entry.Entry, keys map[string]bool) bool {
+	for _, key := range e.Keys {
+		if keys[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// flush sends the entries held for the whole window.
+func (h *conflictHold) flush(out chan *entry.Entry) {
+	for range time.Tick(10 * time.Millisecond) {
+		now := time.Now()
+		h.lock.Lock()
+		n := 0
+		for n < len(h.entries) && !h.entries[n].until.After(now) {
+			n++
+		}
+		expired := make([]*entry.Entry, n)
+		for i := 0; i < n; i++ {
+			expired[i] = h.entries[i].e
+		}
+		h.entries = h.entries[n:]
+		h.lock.Unlock()
+		for _, e := range expired {
+			out <- e
+		}
+	}
+}
+
+func (h *conflictHold) isEmpty() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.entries) == 0
+}
+
+func (h *conflictHold) droppedCount() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.dropped
+}
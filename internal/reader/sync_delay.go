@@ -0,0 +1,111 @@
+package reader
+
+import (
+	"RedisShake/internal/log"
+	"RedisShake/internal/status"
+	"RedisShake/internal/utils/file_rotate"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const aofTimeIndexInterval = 100 * time.Millisecond
+
+// aofFrozen stops all the delayed sync readers from sending AOF, so that a
+// destructive command received from the source is not applied to the target.
+var aofFrozen int32
+var registerFreezeOnce sync.Once
+
+func registerFreezeHandlers() {
+	registerFreezeOnce.Do(func() {
+		status.RegisterHandler("/sync_reader/freeze", freezeHandler(true))
+		status.RegisterHandler("/sync_reader/unfreeze", freezeHandler(false))
+	})
+}
+
+func freezeHandler(freeze bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if freeze {
+			atomic.StoreInt32(&aofFrozen, 1)
+			log.Warnf("sync reader is frozen, AOF will not be sent to target until unfrozen")
+			_, _ = fmt.Fprintln(w, "frozen")
+		} else {
+			atomic.StoreInt32(&aofFrozen, 0)
+			log.Infof("sync reader is unfrozen")
+			_, _ = fmt.Fprintln(w, "unfrozen")
+		}
+	}
+}
+
+func isAOFFrozen() bool {
+	return atomic.LoadInt32(&aofFrozen) == 1
+}
+
+type aofTimePoint struct {
+	time   time.Time
+	offset int64
+}
+
+// aofTimeIndex records when the AOF was received, one point per
+// aofTimeIndexInterval, to find the offset received before a given time.
+type aofTimeIndex struct {
+	lock   sync.Mutex
+	points []aofTimePoint
+}
+
+func newAOFTimeIndex(offset int64) *aofTimeIndex {
+	return &aofTimeIndex{points: []aofTimePoint{{offset: offset}}}
+}
+
+// add records that the AOF is received up to offset now.
+func (i *aofTimeIndex) add(offset int64) {
+	now := time.Now()
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	last := &i.points[len(i.points)-1]
+	if now.Sub(last.time) < aofTimeIndexInterval {
+		last.offset = offset
+		return
+	}
+	i.points = append(i.points, aofTimePoint{time: now, offset: offset})
+}
+
+// offsetBefore returns the offset of the AOF received before t, and forgets
+// the points older than it.
+func (i *aofTimeIndex) offsetBefore(t time.Time) int64 {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for len(i.points) > 1 && !i.points[1].time.After(t) {
+		i.points = i.points[1:]
+	}
+	return i.points[0].offset
+}
+
+// delayedAOFReader reads the AOF spooled on disk only after it has been
+// received for the delay, and stops reading while frozen.
+type delayedAOFReader struct {
+	rd    *rotate.AOFReader
+	index *aofTimeIndex
+	delay time.Duration
+}
+
+func (d *delayedAOFReader) Read(buf []byte) (int, error) {
+	for {
+		if !isAOFFrozen() {
+			available := d.index.offsetBefore(time.Now().Add(-d.delay)) - d.rd.Offset()
+			if available > 0 {
+				if int64(len(buf)) > available {
+					buf = buf[:available]
+				}
+				return d.rd.Read(buf)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,11 +1,13 @@
 package reader
 
 import (
+	"RedisShake/internal/bidirectional"
 	"RedisShake/internal/client"
 	"RedisShake/internal/config"
 	"RedisShake/internal/entry"
 	"RedisShake/internal/log"
 	"RedisShake/internal/rdb"
+	"RedisShake/internal/rdb/types"
 	"RedisShake/internal/utils"
 	"RedisShake/internal/utils/file_rotate"
 	"bufio"
@@ -16,6 +18,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,6 +30,10 @@ type SyncReaderOptions struct {
 	Tls      bool   `mapstructure:"tls" default:"false"`
 	SyncRdb  bool   `mapstructure:"sync_rdb" default:"true"`
 	SyncAof  bool   `mapstructure:"sync_aof" default:"true"`
+	LoadMode string `mapstructure:"load_mode" default:"restore"` // restore or rewrite
+	// Send AOF to the target this many seconds after it is received from the
+	// source, the AOF in between is spooled on disk. 0 means no delay.
+	Delay int `mapstructure:"delay" default:"0"`
 }
 
 type State string
@@ -46,7 +53,9 @@ type syncStandaloneReader struct {
 	ch   chan *entry.Entry
 	DbId int
 
-	rd *bufio.Reader
+	rd       *bufio.Reader
+	aofIndex *aofTimeIndex // for delay
+	filter   *loopFilter   // for bidirectional sync
 
 	stat struct {
 		Name    string `json:"name"`
@@ -70,10 +79,17 @@ type syncStandaloneReader struct {
 		AofSentOffset     int64  `json:"aof_sent_offset"`     // offset of AOF sent to chan
 		AofReceivedBytes  int64  `json:"aof_received_bytes"`  // bytes of AOF received from master
 		AofReceivedHuman  string `json:"aof_received_human"`
+		AofDelaySec       int    `json:"aof_delay_sec"`
+		AofFrozen         bool   `json:"aof_frozen"`
+
+		// bidirectional sync
+		LoopDroppedEntries     int64 `json:"loop_dropped_entries"`     // entries written by redis-shake on this side
+		ConflictDroppedEntries int64 `json:"conflict_dropped_entries"` // entries overwritten by the higher priority side
 	}
 }
 
 func NewSyncStandaloneReader(opts *SyncReaderOptions) Reader {
+	types.CheckLoadMode(opts.LoadMode)
 	r := new(syncStandaloneReader)
 	r.opts = opts
 	r.client = client.NewRedisClient(opts.Address, opts.Username, opts.Password, opts.Tls)
@@ -83,6 +99,16 @@ func NewSyncStandaloneReader(opts *SyncReaderOptions) Reader {
 	r.stat.Status = kHandShake
 	r.stat.Dir = utils.GetAbsPath(r.stat.Name)
 	utils.CreateEmptyDir(r.stat.Dir)
+	if opts.Delay < 0 {
+		log.Panicf("invalid delay: [%d], must not be negative", opts.Delay)
+	}
+	r.stat.AofDelaySec = opts.Delay
+	if opts.Delay > 0 {
+		if config.Opt.Advanced.StatusPort == 0 {
+			log.Panicf("delay requires status_port to freeze the replay")
+		}
+		registerFreezeHandlers()
+	}
 	return r
 }
 
@@ -94,6 +120,9 @@ func (r *syncStandaloneReader) StartRead() chan *entry.Entry {
 		go r.sendReplconfAck() // start sent replconf ack
 		r.receiveRDB()
 		startOffset := r.stat.AofReceivedOffset
+		if r.opts.Delay > 0 {
+			r.aofIndex = newAOFTimeIndex(startOffset)
+		}
 		go r.receiveAOF(r.rd)
 		if r.opts.SyncRdb {
 			r.sendRDB()
@@ -232,6 +261,9 @@ func (r *syncStandaloneReader) receiveAOF(rd io.Reader) {
 		r.stat.AofReceivedHuman = humanize.IBytes(uint64(r.stat.AofReceivedBytes))
 		aofWriter.Write(buf[:n])
 		r.stat.AofReceivedOffset += int64(n)
+		if r.aofIndex != nil {
+			r.aofIndex.add(r.stat.AofReceivedOffset)
+		}
 	}
 }
 
@@ -243,7 +275,7 @@ func (r *syncStandaloneReader) sendRDB() {
 		r.stat.RdbSentBytes = offset
 		r.stat.RdbSentHuman = humanize.IBytes(uint64(offset))
 	}
-	rdbLoader := rdb.NewLoader(r.stat.Name, updateFunc, r.stat.RdbFilePath, r.ch)
+	rdbLoader := rdb.NewLoader(r.stat.Name, updateFunc, r.stat.RdbFilePath, r.ch, r.opts.LoadMode)
 	r.DbId = rdbLoader.ParseRDB()
 	log.Debugf("[%s] send RDB finished", r.stat.Name)
 }
@@ -252,7 +284,15 @@ func (r *syncStandaloneReader) sendAOF(offset int64) {
 	time.Sleep(1 * time.Second) // wait for receiveAOF create aof file
 	aofReader := rotate.NewAOFReader(r.stat.Name, r.stat.Dir, offset)
 	defer aofReader.Close()
-	r.client.SetBufioReader(bufio.NewReader(aofReader))
+	var rd io.Reader = aofReader
+	if r.opts.Delay > 0 {
+		log.Infof("[%s] send AOF with a delay of %d seconds", r.stat.Name, r.opts.Delay)
+		rd = &delayedAOFReader{rd: aofReader, index: r.aofIndex, delay: time.Duration(r.opts.Delay) * time.Second}
+	}
+	r.client.SetBufioReader(bufio.NewReader(rd))
+	if bidirectional.Enabled() {
+		r.filter = newLoopFilter(r.stat.Name, r.ch)
+	}
 	for {
 		argv := client.ArrayString(r.client.Receive())
 		r.stat.AofSentOffset = aofReader.Offset()
@@ -285,6 +325,11 @@ func (r *syncStandaloneReader) sendAOF(offset int64) {
 		e := entry.NewEntry()
 		e.Argv = argv
 		e.DbId = r.DbId
+		if r.filter != nil {
+			e.Parse()
+			r.filter.send(e)
+			continue
+		}
 		r.ch <- e
 	}
 }
@@ -299,6 +344,13 @@ func (r *syncStandaloneReader) sendReplconfAck() {
 }
 
 func (r *syncStandaloneReader) Status() interface{} {
+	r.stat.AofFrozen = isAOFFrozen()
+	if r.filter != nil {
+		r.stat.LoopDroppedEntries = atomic.LoadInt64(&r.filter.dropped)
+		if r.filter.hold != nil {
+			r.stat.ConflictDroppedEntries = r.filter.hold.droppedCount()
+		}
+	}
 	return r.stat
 }
 
@@ -307,6 +359,9 @@ func (r *syncStandaloneReader) StatusString() string {
 		return fmt.Sprintf("%s, size=[%s/%s]", r.stat.Status, r.stat.RdbSentHuman, r.stat.RdbFileSizeHuman)
 	}
 	if r.stat.Status == kSyncAof {
+		if isAOFFrozen() {
+			return fmt.Sprintf("%s, frozen, diff=[%v]", r.stat.Status, -r.stat.AofSentOffset+r.stat.AofReceivedOffset)
+		}
 		return fmt.Sprintf("%s, diff=[%v]", r.stat.Status, -r.stat.AofSentOffset+r.stat.AofReceivedOffset)
 	}
 	return string(r.stat.Status)
@@ -315,5 +370,6 @@ func (r *syncStandaloneReader) StatusString() string {
 func (r *syncStandaloneReader) StatusConsistent() bool {
 	return r.stat.AofReceivedOffset != 0 &&
 		r.stat.AofReceivedOffset == r.stat.AofSentOffset &&
+		(r.filter == nil || r.filter.isEmpty()) &&
 		len(r.ch) == 0
 }
@@ -37,11 +37,19 @@ func Handler(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+var mux = http.NewServeMux()
+
+// RegisterHandler registers an API served on the status port besides the status information.
+func RegisterHandler(pattern string, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, handler)
+}
+
 func setStatusPort() {
 	if config.Opt.Advanced.StatusPort != 0 {
+		mux.HandleFunc("/", Handler)
 		go func() {
 			addr := fmt.Sprintf(":%d", config.Opt.Advanced.StatusPort)
-			if err := http.ListenAndServe(addr, http.HandlerFunc(Handler)); err != nil {
+			if err := http.ListenAndServe(addr, mux); err != nil {
 				log.Panicf(err.Error())
 			}
 		}()
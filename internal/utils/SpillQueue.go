@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"RedisShake/internal/log"
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+)
+
+// QueueCodec encodes the items of SpillQueue to spill them to disk.
+type QueueCodec interface {
+	Encode(item interface{}) []byte
+	Decode(data []byte) interface{}
+}
+
+// SpillQueue is a FIFO queue whose Put never blocks: once size items are in
+// memory, the following items are appended to a file until the file is
+// drained. Items waiting in the queue are deduplicated, but only the first
+// size items on disk are indexed for it, so an item may be queued twice once
+// many items are spilled. Repeats of the last spilled item are always
+// collapsed.
+type SpillQueue struct {
+	mem chan interface{}
+	set map[interface{}]bool
+	// spilled items indexed for deduplication, at most cap(mem)
+	spilledSet  map[interface{}]bool
+	lastSpilled interface{}
+	lock        sync.Mutex
+	cond        *sync.Cond // signaled when items are put or the queue is closed
+	codec       QueueCodec
+
+	path      string
+	writer    *os.File
+	bufWriter *bufio.Writer
+	reader    *bufio.Reader
+	readFile  *os.File
+	spilled   int // items on disk
+	closed    bool
+
+	Ch chan interface{}
+}
+
+func NewSpillQueue(size int, path string, codec QueueCodec) *SpillQueue {
+	q := new(SpillQueue)
+	q.mem = make(chan interface{}, size)
+	q.set = make(map[interface{}]bool)
+	q.spilledSet = make(map[interface{}]bool)
+	q.cond = sync.NewCond(&q.lock)
+	q.codec = codec
+	q.path = path
+	q.Ch = make(chan interface{})
+	go q.pump()
+	return q
+}
+
+func (q *SpillQueue) Put(item interface{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed || q.set[item] || q.spilledSet[item] || (q.spilled > 0 && q.lastSpilled == item) {
+		return
+	}
+	if q.spilled == 0 && len(q.mem) < cap(q.mem) {
+		q.set[item] = true
+		q.mem <- item // never blocks, only Put sends to mem
+		q.cond.Signal()
+		return
+	}
+	q.spill(item)
+	q.cond.Signal()
+}
+
+func (q *SpillQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.mem) + q.spilled
+}
+
+func (q *SpillQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	close(q.mem)
+	q.cond.Signal()
+}
+
+// Spilled returns the number of items on disk.
+func (q *SpillQueue) Spilled() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.spilled
+}
+
+func (q *SpillQueue) pump() {
+	for {
+		item, ok := q.next()
+		if !ok {
+			close(q.Ch)
+			return
+		}
+		q.Ch <- item
+	}
+}
+
+// next returns the items in memory first, they are put before the items on
+// disk.
+func (q *SpillQueue) next() (interface{}, bool) {
+	for {
+		select {
+		case item, ok := <-q.mem:
+			if ok {
+				q.lock.Lock()
+				delete(q.set, item)
+				q.lock.Unlock()
+				return item, true
+			}
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			if q.spilled > 0 {
+				return q.unspill(), true
+			}
+			return nil, false
+		default:
+		}
+		q.lock.Lock()
+		for len(q.mem) == 0 && q.spilled == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.mem) == 0 && q.spilled > 0 {
+			item := q.unspill()
+			q.lock.Unlock()
+			return item, true
+		}
+		q.lock.Unlock()
+	}
+}
+
+// spill appends the item to the file, called with lock held.
+func (q *SpillQueue) spill(item interface{}) {
+	if q.writer == nil {
+		var err error
+		q.writer, err = os.OpenFile(q.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			log.Panicf("open spill file failed. file=[%s], err=[%v]", q.path, err)
+		}
+		q.bufWriter = bufio.NewWriter(q.writer)
+		q.readFile, err = os.Open(q.path)
+		if err != nil {
+			log.Panicf("open spill file failed. file=[%s], err=[%v]", q.path, err)
+		}
+		q.reader = bufio.NewReader(q.readFile)
+		log.Infof("key queue is full, spill keys to file. file=[%s]", q.path)
+	}
+	data := q.codec.Encode(item)
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(len(data)))
+	if _, err := q.bufWriter.Write(header[:n]); err != nil {
+		log.Panicf("write spill file failed. file=[%s], err=[%v]", q.path, err)
+	}
+	if _, err := q.bufWriter.Write(data); err != nil {
+		log.Panicf("write spill file failed. file=[%s], err=[%v]", q.path, err)
+	}
+	q.spilled++
+	q.lastSpilled = item
+	if len(q.spilledSet) < cap(q.mem) {
+		q.spilledSet[item] = true
+	}
+}
+
+// unspill reads the first item on disk, called with lock held. The file is
+// removed after it is drained.
+func (q *SpillQueue) unspill() interface{} {
+	if q.bufWriter.Buffered() > 0 {
+		if err := q.bufWriter.Flush(); err != nil {
+			log.Panicf("write spill file failed. file=[%s], err=[%v]", q.path, err)
+		}
+	}
+	length, err := binary.ReadUvarint(q.reader)
+	if err != nil {
+		log.Panicf("read spill file failed. file=[%s], err=[%v]", q.path, err)
+	}
+	data := make([]byte, length)
+	if _, err = io.ReadFull(q.reader, data); err != nil {
+		log.Panicf("read spill file failed. file=[%s], err=[%v]", q.path, err)
+	}
+	item := q.codec.Decode(data)
+	// a later copy of an item not indexed may be indexed, deleting it only
+	// makes the item queued twice
+	delete(q.spilledSet, item)
+	q.spilled--
+	if q.spilled == 0 {
+		q.lastSpilled = nil
+		_ = q.readFile.Close()
+		_ = q.writer.Close()
+		if err = os.Remove(q.path); err != nil {
+			log.Warnf("remove spill file failed. file=[%s], err=[%v]", q.path, err)
+		}
+		q.writer, q.bufWriter, q.readFile, q.reader = nil, nil, nil, nil
+		log.Infof("spilled keys are drained. file=[%s]", q.path)
+	}
+	return item
+}
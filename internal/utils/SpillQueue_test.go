@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type stringCodec struct{}
+
+func (stringCodec) Encode(item interface{}) []byte { return []byte(item.(string)) }
+func (stringCodec) Decode(data []byte) interface{} { return string(data) }
+
+func TestSpillQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spill")
+	q := NewSpillQueue(2, path, stringCodec{})
+	want := []string{"a", "b", "c", "d", "e", "f"}
+	for _, item := range want {
+		q.Put(item) // never blocks though nobody reads
+	}
+	if q.Spilled() < 3 {
+		t.Fatalf("spilled = %d, want at least 3", q.Spilled())
+	}
+	q.Close()
+	var got []string
+	for item := range q.Ch {
+		got = append(got, item.(string))
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	if IsExist(path) {
+		t.Fatalf("spill file is not removed after drained")
+	}
+}
+
+func TestSpillQueueDedup(t *testing.T) {
+	q := NewSpillQueue(2, filepath.Join(t.TempDir(), "spill"), stringCodec{})
+	for _, item := range []string{"a", "b", "c", "d", "e", "f"} {
+		q.Put(item)
+	}
+	// d is among the first spilled items indexed, f is the last spilled one
+	for _, item := range []string{"d", "f", "f"} {
+		q.Put(item)
+	}
+	q.Close()
+	var got []string
+	for item := range q.Ch {
+		got = append(got, item.(string))
+	}
+	want := []string{"a", "b", "c", "d", "e", "f"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSpillQueuePutAfterWait(t *testing.T) {
+	q := NewSpillQueue(10, filepath.Join(t.TempDir(), "spill"), stringCodec{})
+	defer q.Close()
+	time.Sleep(100 * time.Millisecond) // the consumer is waiting on the empty queue
+	q.Put("a")
+	select {
+	case item := <-q.Ch:
+		if item != "a" {
+			t.Fatalf("got %v, want a", item)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("item put after the consumer waits is not delivered")
+	}
+}
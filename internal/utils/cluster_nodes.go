@@ -11,8 +11,21 @@ import (
 func GetRedisClusterNodes(address string, username string, password string, Tls bool) (addresses []string, slots [][]int) {
 	c := client.NewRedisClient(address, username, password, Tls)
 	reply := c.DoWithStringReply("cluster", "nodes")
-	reply = strings.TrimSpace(reply)
+	addresses, slots = parseClusterNodes(reply)
 	slotsCount := 0
+	for _, slot := range slots {
+		slotsCount += len(slot)
+	}
+	if slotsCount != 16384 {
+		log.Panicf("invalid cluster nodes slots. slots_count=%v, address=%v", slotsCount, address)
+	}
+	return addresses, slots
+}
+
+// parseClusterNodes returns the addresses of the masters holding slots in the
+// reply of CLUSTER NODES, and the slots of each of them.
+func parseClusterNodes(reply string) (addresses []string, slots [][]int) {
+	reply = strings.TrimSpace(reply)
 	for _, line := range strings.Split(reply, "\n") {
 		line = strings.TrimSpace(line)
 		words := strings.Split(line, " ")
@@ -66,13 +79,9 @@ func GetRedisClusterNodes(address string, username string, password string, Tls
 			}
 			for j := start; j <= end; j++ {
 				slot = append(slot, j)
-				slotsCount++
 			}
-			slots = append(slots, slot)
 		}
-	}
-	if slotsCount != 16384 {
-		log.Panicf("invalid cluster nodes slots. slots_count=%v, address=%v", slotsCount, address)
+		slots = append(slots, slot)
 	}
 	return addresses, slots
 }
@@ -0,0 +1,30 @@
+package utils
+
+import "testing"
+
+func TestParseClusterNodes(t *testing.T) {
+	// a master with multiple slot ranges gets all of them as one node
+	reply := `07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected
+67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002 master - 0 1426238316232 2 connected 5461-10922
+292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 127.0.0.1:30003@31003 master - 0 1426238318243 3 connected 10923-16383
+e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-100 101 102-5460
+6ec23923021cf3ffec47632106199cb7f496ce01 127.0.0.1:30005@31005 master - 0 1426238316232 5 connected
+824fe116063bc5fcf9f4ffd895bc17aee7731ac3 ::1:30006@31006 master - 0 1426238316232 6 connected`
+	addresses, slots := parseClusterNodes(reply)
+	wantAddresses := []string{"127.0.0.1:30002", "127.0.0.1:30003", "127.0.0.1:30001"}
+	wantCounts := []int{5462, 5461, 5461}
+	if len(addresses) != len(wantAddresses) || len(slots) != len(wantAddresses) {
+		t.Fatalf("addresses = %v, %d slot lists, want %v", addresses, len(slots), wantAddresses)
+	}
+	for i := range wantAddresses {
+		if addresses[i] != wantAddresses[i] {
+			t.Errorf("address %d = %s, want %s", i, addresses[i], wantAddresses[i])
+		}
+		if len(slots[i]) != wantCounts[i] {
+			t.Errorf("node %s has %d slots, want %d", addresses[i], len(slots[i]), wantCounts[i])
+		}
+	}
+	if slots[2][0] != 0 || slots[2][101] != 101 || slots[2][len(slots[2])-1] != 5460 {
+		t.Errorf("slots of the node with multiple ranges are wrong")
+	}
+}
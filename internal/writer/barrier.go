@@ -0,0 +1,124 @@
+package writer
+
+import (
+	"RedisShake/internal/client"
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	barrierModeNone    = ""
+	barrierModeWait    = "wait"
+	barrierModeWaitAOF = "waitaof"
+)
+
+type barrier struct {
+	e      *entry.Entry
+	offset int64 // entries sent before the barrier
+}
+
+func checkBarrierMode(mode string) {
+	switch mode {
+	case barrierModeNone, barrierModeWait, barrierModeWaitAOF:
+	default:
+		log.Panicf("invalid barrier_mode: [%s], must be one of \"\", wait or waitaof", mode)
+	}
+}
+
+// startBarrier sends a durability barrier periodically when there are new
+// entries since the last one. The durable offset is advanced only after the
+// target confirms that the entries reached its replicas or AOF.
+func (w *redisStandaloneWriter) startBarrier() {
+	if w.opts.BarrierMode == barrierModeNone {
+		return
+	}
+	w.barrierTicker = time.NewTicker(time.Duration(w.opts.BarrierInterval) * time.Millisecond)
+	go func() {
+		for range w.barrierTicker.C {
+			w.sendLock.Lock()
+			w.sendBarrierIfNeeded()
+			w.sendLock.Unlock()
+		}
+	}()
+}
+
+// sendBarrierIfNeeded must be called with sendLock held. The barrier is not
+// sent inside a transaction from the source, it would be queued by MULTI.
+func (w *redisStandaloneWriter) sendBarrierIfNeeded() {
+	if w.closed || w.inTransaction || atomic.LoadInt64(&w.durableOffset) == atomic.LoadInt64(&w.sentOffset) {
+		return
+	}
+	w.barrierLock.Lock()
+	inflight := len(w.barriers)
+	w.barrierLock.Unlock()
+	if inflight != 0 {
+		return // wait for the previous barrier
+	}
+	var argv []string
+	timeout := strconv.Itoa(w.opts.BarrierTimeout)
+	replicas := strconv.Itoa(w.opts.BarrierReplicas)
+	if w.opts.BarrierMode == barrierModeWait {
+		argv = []string{"WAIT", replicas, timeout}
+	} else {
+		local := "0"
+		if w.opts.BarrierAOFLocal {
+			local = "1"
+		}
+		argv = []string{"WAITAOF", local, replicas, timeout}
+	}
+	e := &entry.Entry{Argv: argv, CmdName: strings.ToLower(argv[0])}
+	w.barrierLock.Lock()
+	w.barriers = append(w.barriers, barrier{e: e, offset: w.sentOffset})
+	w.barrierLock.Unlock()
+	log.Debugf("[%s] send barrier. cmd=[%s], offset=[%d]", w.stat.Name, e.String(), w.sentOffset)
+	w.enqueue(e)
+	w.client.Send(argv...)
+}
+
+// popBarrier returns the barrier if e is the oldest barrier in flight.
+func (w *redisStandaloneWriter) popBarrier(e *entry.Entry) (barrier, bool) {
+	w.barrierLock.Lock()
+	defer w.barrierLock.Unlock()
+	if len(w.barriers) == 0 || w.barriers[0].e != e {
+		return barrier{}, false
+	}
+	b := w.barriers[0]
+	w.barriers = w.barriers[1:]
+	return b, true
+}
+
+func (w *redisStandaloneWriter) processBarrierReply(b barrier, reply interface{}, err error) {
+	if err != nil && isRetryableError(err) {
+		log.Warnf("[%s] barrier failed, durable offset is not advanced. cmd=[%s], error=[%v]", w.stat.Name, b.e.String(), err)
+		return
+	}
+	if err != nil {
+		log.Panicf("[%s] barrier failed. cmd=[%s], error=[%v]", w.stat.Name, b.e.String(), err)
+	}
+	var acked int64
+	if w.opts.BarrierMode == barrierModeWait {
+		acked, err = client.Int64(reply, nil)
+	} else {
+		// WAITAOF replies [numlocal, numreplicas]
+		array, ok := reply.([]interface{})
+		if !ok || len(array) != 2 {
+			log.Panicf("[%s] invalid barrier reply. cmd=[%s], reply=[%v]", w.stat.Name, b.e.String(), reply)
+		}
+		acked, err = client.Int64(array[1], nil)
+		if local, _ := client.Int64(array[0], nil); w.opts.BarrierAOFLocal && local < 1 {
+			acked = -1
+		}
+	}
+	if err != nil {
+		log.Panicf("[%s] invalid barrier reply. cmd=[%s], reply=[%v]", w.stat.Name, b.e.String(), reply)
+	}
+	if acked < int64(w.opts.BarrierReplicas) {
+		log.Warnf("[%s] barrier timeout, durable offset is not advanced. cmd=[%s], reply=[%v]", w.stat.Name, b.e.String(), reply)
+		return
+	}
+	atomic.StoreInt64(&w.durableOffset, b.offset)
+}
@@ -0,0 +1,79 @@
+package writer
+
+import (
+	"RedisShake/internal/bidirectional"
+	"RedisShake/internal/client/proto"
+	"RedisShake/internal/entry"
+	"fmt"
+	"sync"
+)
+
+var markerOnce sync.Once
+var markerPrefix, markerSuffix []byte
+
+func newMarkerEntry(dbId int) *entry.Entry {
+	e := entry.NewEntry()
+	e.DbId = dbId
+	e.Argv = bidirectional.MarkerArgv()
+	e.Parse()
+	return e
+}
+
+// wrapWithMarker wraps the serialized command as MULTI, marker PUBLISH, the
+// command and EXEC, so that the sync reader on the other side of a
+// bidirectional sync can recognize the command and not send it back.
+func wrapWithMarker(bytes []byte) []byte {
+	markerOnce.Do(func() {
+		multi := &entry.Entry{Argv: []string{"MULTI"}}
+		markerPrefix = append(multi.Serialize(), newMarkerEntry(0).Serialize()...)
+		exec := &entry.Entry{Argv: []string{"EXEC"}}
+		markerSuffix = exec.Serialize()
+	})
+	wrapped := make([]byte, 0, len(markerPrefix)+len(bytes)+len(markerSuffix))
+	wrapped = append(wrapped, markerPrefix...)
+	wrapped = append(wrapped, bytes...)
+	return append(wrapped, markerSuffix...)
+}
+
+// needMarker returns whether the entry should be wrapped by wrapWithMarker.
+// The transactions from the source are not wrapped, a marker PUBLISH is sent
+// after their MULTI instead.
+func (w *redisStandaloneWriter) needMarker(e *entry.Entry) bool {
+	if !bidirectional.Enabled() {
+		return false
+	}
+	switch e.CmdName {
+	case "MULTI", "EXEC", "DISCARD":
+		return false
+	}
+	return !w.inTransaction
+}
+
+// receiveWrappedReply reads the replies of MULTI, marker PUBLISH, the command
+// and EXEC, and returns the reply of the command.
+func (w *redisStandaloneWriter) receiveWrappedReply() (interface{}, error) {
+	var queueErr error
+	for i := 0; i < 3; i++ {
+		if _, err := w.client.Receive(); err != nil && queueErr == nil {
+			queueErr = err
+		}
+	}
+	reply, err := w.client.Receive()
+	if err != nil {
+		if queueErr != nil { // EXECABORT, the error of the command is more useful
+			return nil, queueErr
+		}
+		return nil, err
+	}
+	replies, ok := reply.([]interface{})
+	if !ok || len(replies) != 2 {
+		return nil, fmt.Errorf("unexpected EXEC reply of the wrapped command: %v", reply)
+	}
+	switch v := replies[1].(type) {
+	case nil:
+		return nil, proto.Nil
+	case proto.RedisError:
+		return nil, v
+	}
+	return replies[1], nil
+}
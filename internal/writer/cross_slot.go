@@ -0,0 +1,153 @@
+package writer
+
+import (
+	"RedisShake/internal/client"
+	"RedisShake/internal/client/proto"
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"strconv"
+	"strings"
+)
+
+// splittableCommands are the multi-key commands that keep their semantics
+// when split into one command per slot. The value is the number of arguments
+// that belong to each key, starting right after the command name.
+var splittableCommands = map[string]int{
+	"DEL":    1,
+	"UNLINK": 1,
+	"TOUCH":  1,
+	"EXISTS": 1,
+	"MSET":   2,
+}
+
+func isSameSlot(slots []int) bool {
+	for _, slot := range slots {
+		if slot != slots[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// splitCrossSlotEntry splits a multi-key entry whose keys hash to different
+// slots into one entry per slot, in the order the slots first appear.
+// Returns nil if the command can not be split.
+func splitCrossSlotEntry(e *entry.Entry) []*entry.Entry {
+	step, ok := splittableCommands[e.CmdName]
+	if !ok {
+		return nil
+	}
+	if (len(e.Argv)-1)%step != 0 || (len(e.Argv)-1)/step != len(e.Keys) {
+		return nil
+	}
+
+	var entries []*entry.Entry
+	slotToEntry := make(map[int]*entry.Entry)
+	for inx, slot := range e.Slots {
+		argvInx := 1 + inx*step
+		newEntry, ok := slotToEntry[slot]
+		if !ok {
+			newEntry = entry.NewEntry()
+			newEntry.DbId = e.DbId
+			newEntry.Argv = []string{e.Argv[0]}
+			slotToEntry[slot] = newEntry
+			entries = append(entries, newEntry)
+		}
+		newEntry.Argv = append(newEntry.Argv, e.Argv[argvInx:argvInx+step]...)
+	}
+	for _, newEntry := range entries {
+		newEntry.Parse()
+	}
+	return entries
+}
+
+// copyAcrossSlots applies a cross slot RENAME, RENAMENX or COPY to redis
+// cluster by reading the value from the source node with DUMP and writing it
+// to the destination node with RESTORE. Returns false if the command is not
+// supported.
+//
+// It stalls the pipeline: it waits for the replies of all the commands sent
+// to both nodes, then reads the value with DUMP and PTTL (and EXISTS without
+// REPLACE) in synchronous round trips before RESTORE is sent, so every cross
+// slot command costs several round trips with nothing else in flight.
+func (r *RedisClusterWriter) copyAcrossSlots(e *entry.Entry) bool {
+	if len(e.Keys) != 2 {
+		return false
+	}
+	var replace, deleteSource bool
+	switch e.CmdName {
+	case "RENAME":
+		replace, deleteSource = true, true
+	case "RENAMENX":
+		replace, deleteSource = false, true
+	case "COPY":
+		for _, arg := range e.Argv[3:] {
+			switch strings.ToUpper(arg) {
+			case "REPLACE":
+				replace = true
+			default:
+				return false // DB option is not supported by redis cluster
+			}
+		}
+	default:
+		return false
+	}
+	srcKey, dstKey := e.Keys[0], e.Keys[1]
+	srcSlot, dstSlot := e.Slots[0], e.Slots[1]
+
+	// make sure all the previous commands on both nodes have been applied
+	r.router[srcSlot].waitReplied()
+	r.router[dstSlot].waitReplied()
+
+	srcClient := r.getClient(srcSlot)
+	srcClient.Send("DUMP", srcKey)
+	srcClient.Send("PTTL", srcKey)
+	dump, err := srcClient.Receive()
+	pttl, err2 := client.Int64(srcClient.Receive())
+	if err == proto.Nil || pttl == -2 {
+		log.Warnf("redisClusterWriter: source key does not exist, skip it. key=[%s], cmd=[%s]", srcKey, e.String())
+		return true
+	} else if err != nil {
+		log.Panicf("redisClusterWriter: dump key failed. key=[%s], error=[%v]", srcKey, err)
+	} else if err2 != nil {
+		log.Panicf("redisClusterWriter: pttl key failed. key=[%s], error=[%v]", srcKey, err2)
+	}
+	if pttl == -1 {
+		pttl = 0
+	}
+	if !replace {
+		exists, err := client.Int64(r.getClient(dstSlot).Do("EXISTS", dstKey), nil)
+		if err != nil {
+			log.Panicf("redisClusterWriter: exists key failed. key=[%s], error=[%v]", dstKey, err)
+		}
+		if exists == 1 {
+			return true // destination exists, nothing to do
+		}
+	}
+
+	restore := entry.NewEntry()
+	restore.Argv = []string{"RESTORE", dstKey, strconv.FormatInt(pttl, 10), dump.(string)}
+	if replace {
+		restore.Argv = append(restore.Argv, "REPLACE")
+	}
+	restore.Parse()
+	r.router[dstSlot].Write(restore)
+	if deleteSource {
+		del := entry.NewEntry()
+		del.Argv = []string{"DEL", srcKey}
+		del.Parse()
+		r.router[srcSlot].Write(del)
+	}
+	log.Debugf("redisClusterWriter: copied key across slots. cmd=[%s]", e.String())
+	return true
+}
+
+func (r *RedisClusterWriter) getClient(slot int) *client.Redis {
+	address := r.routerAddress[slot]
+	c, ok := r.clients[address]
+	if !ok {
+		c = client.NewRedisClientWithProtocol(address, r.opts.Username, r.opts.Password, r.opts.Tls, r.opts.Protocol)
+		r.clients[address] = c
+	}
+	return c
+}
@@ -0,0 +1,48 @@
+package writer
+
+import (
+	"RedisShake/internal/entry"
+	"strings"
+	"testing"
+)
+
+func newParsedEntry(argv ...string) *entry.Entry {
+	e := entry.NewEntry()
+	e.Argv = argv
+	e.Parse()
+	return e
+}
+
+func TestSplitCrossSlotEntry(t *testing.T) {
+	// MSET
+	e := newParsedEntry("MSET", "{a}1", "v1", "{b}1", "v2", "{a}2", "v3")
+	entries := splitCrossSlotEntry(e)
+	if len(entries) != 2 {
+		t.Fatalf("splitCrossSlotEntry(MSET) failed. len=%d", len(entries))
+	}
+	if strings.Join(entries[0].Argv, " ") != "MSET {a}1 v1 {a}2 v3" || strings.Join(entries[1].Argv, " ") != "MSET {b}1 v2" {
+		t.Errorf("splitCrossSlotEntry(MSET) failed. entries=%v, %v", entries[0].Argv, entries[1].Argv)
+	}
+
+	// DEL
+	e = newParsedEntry("del", "{a}1", "{b}1", "{c}1")
+	entries = splitCrossSlotEntry(e)
+	if len(entries) != 3 {
+		t.Fatalf("splitCrossSlotEntry(DEL) failed. len=%d", len(entries))
+	}
+	for inx, key := range []string{"{a}1", "{b}1", "{c}1"} {
+		if strings.Join(entries[inx].Argv, " ") != "del "+key || len(entries[inx].Slots) != 1 {
+			t.Errorf("splitCrossSlotEntry(DEL) failed. argv=%v", entries[inx].Argv)
+		}
+	}
+
+	// not splittable
+	e = newParsedEntry("SUNIONSTORE", "{a}dst", "{b}1", "{c}1")
+	if splitCrossSlotEntry(e) != nil {
+		t.Errorf("splitCrossSlotEntry(SUNIONSTORE) should return nil")
+	}
+	e = newParsedEntry("MSETNX", "{a}1", "v1", "{b}1", "v2")
+	if splitCrossSlotEntry(e) != nil {
+		t.Errorf("splitCrossSlotEntry(MSETNX) should return nil")
+	}
+}
@@ -0,0 +1,256 @@
+package writer
+
+import (
+	"RedisShake/internal/deadletter"
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// scriptSelectRegex matches redis.call('select', ...) and redis.pcall("SELECT", ...) in lua scripts.
+var scriptSelectRegex = regexp.MustCompile(`(?i)p?call\s*\(\s*['"]select['"]`)
+
+type dbMapper struct {
+	mapping      map[int]int
+	foldDb       bool
+	foldDbPrefix string
+	cluster      bool
+
+	dbCommandBehavior string
+}
+
+func newDbMapper(opts *RedisWriterOptions) *dbMapper {
+	m := new(dbMapper)
+	m.mapping = make(map[int]int)
+	for source, target := range opts.DbMapping {
+		sourceDbId, err := strconv.Atoi(source)
+		if err != nil {
+			log.Panicf("invalid db_mapping. source db=[%s], err=[%v]", source, err)
+		}
+		if sourceDbId < 0 || target < 0 {
+			log.Panicf("invalid db_mapping. source db=[%d], target db=[%d]", sourceDbId, target)
+		}
+		m.mapping[sourceDbId] = target
+	}
+	m.foldDb = opts.FoldDb
+	m.foldDbPrefix = opts.FoldDbPrefix
+	if m.foldDb && strings.Contains(m.foldDbPrefix, "{") {
+		log.Panicf("fold_db_prefix must not contain '{', otherwise hash tags of keys will be broken. fold_db_prefix=[%s]", m.foldDbPrefix)
+	}
+	m.cluster = opts.Cluster
+	deadletter.CheckBehavior("db_command_behavior", opts.DbCommandBehavior)
+	m.dbCommandBehavior = opts.DbCommandBehavior
+	return m
+}
+
+func (m *dbMapper) isIdentity() bool {
+	return len(m.mapping) == 0 && !m.foldDb
+}
+
+func (m *dbMapper) mapDb(dbId int) int {
+	if target, ok := m.mapping[dbId]; ok {
+		return target
+	}
+	return dbId
+}
+
+// isShared returns true if more than one source db is written to the target db.
+func (m *dbMapper) isShared(targetDbId int) bool {
+	count := 0
+	if _, ok := m.mapping[targetDbId]; !ok {
+		count++ // the source db with the same id is not mapped away
+	}
+	for _, target := range m.mapping {
+		if target == targetDbId {
+			count++
+		}
+	}
+	return count > 1
+}
+
+func (m *dbMapper) keyPrefix(dbId int) string {
+	return strings.ReplaceAll(m.foldDbPrefix, "%d", strconv.Itoa(dbId))
+}
+
+// locate returns the target db and the key prefix of a source db.
+func (m *dbMapper) locate(sourceDbId int) (dbId int, prefix string) {
+	dbId = m.mapDb(sourceDbId)
+	if m.foldDb && dbId != 0 {
+		return 0, m.keyPrefix(dbId)
+	}
+	return dbId, ""
+}
+
+func (m *dbMapper) reject(e *entry.Entry, reason string) []*entry.Entry {
+	deadletter.Reject(m.dbCommandBehavior, e, reason)
+	return nil
+}
+
+// apply maps the db of the entry, folds it into db 0 if fold_db is enabled,
+// and translates the commands that reference other dbs, also when the target
+// is a cluster without db_mapping and fold_db. Returns the entries
+// to write, which may be empty if the command is rejected or has no effect
+// on the target.
+func (m *dbMapper) apply(e *entry.Entry) []*entry.Entry {
+	if m.isIdentity() && !m.cluster { // redis cluster only has db 0
+		return []*entry.Entry{e}
+	}
+
+	sourceDbId := e.DbId
+	dbId, prefix := m.locate(sourceDbId)
+	switch e.CmdName {
+	case "SWAPDB":
+		return m.applySwapDb(e)
+	case "MOVE":
+		return m.applyMove(e, sourceDbId)
+	case "COPY":
+		return m.applyCopy(e, sourceDbId)
+	case "FLUSHALL":
+		return m.applyFlushAll(e)
+	case "FLUSHDB":
+		if m.foldDb {
+			return m.reject(e, "FLUSHDB can not be applied when fold_db is enabled")
+		}
+		if m.isShared(dbId) {
+			return m.reject(e, "FLUSHDB can not be applied to a target db shared by several source dbs")
+		}
+	case "EVAL", "EVAL_RO":
+		if len(e.Argv) > 1 && scriptSelectRegex.MatchString(e.Argv[1]) {
+			return m.reject(e, "SELECT inside a script can not be applied when db_mapping or fold_db is set or the target is a cluster")
+		}
+	}
+
+	e.DbId = dbId
+	if prefix != "" {
+		e.AddKeyPrefix(prefix)
+	}
+	return []*entry.Entry{e}
+}
+
+// applyFlushAll translates "FLUSHALL [ASYNC|SYNC]". When fold_db is enabled,
+// all the source dbs are in db 0, so it is turned into FLUSHDB of db 0.
+func (m *dbMapper) applyFlushAll(e *entry.Entry) []*entry.Entry {
+	if m.foldDb {
+		newEntry := entry.NewEntry()
+		newEntry.Argv = append([]string{"FLUSHDB"}, e.Argv[1:]...)
+		newEntry.Parse()
+		return []*entry.Entry{newEntry}
+	}
+	for source := range m.mapping {
+		if m.mapDb(source) != source && !m.isTarget(source) {
+			return m.reject(e, fmt.Sprintf("FLUSHALL can not be applied when target db %d is not written by any source db", source))
+		}
+	}
+	return []*entry.Entry{e}
+}
+
+// isTarget returns true if a source db is mapped to the target db.
+func (m *dbMapper) isTarget(targetDbId int) bool {
+	for _, target := range m.mapping {
+		if target == targetDbId {
+			return true
+		}
+	}
+	return false
+}
+
+// applySwapDb translates "SWAPDB index1 index2".
+func (m *dbMapper) applySwapDb(e *entry.Entry) []*entry.Entry {
+	if len(e.Argv) != 3 {
+		return m.reject(e, "invalid SWAPDB command")
+	}
+	db1, err1 := strconv.Atoi(e.Argv[1])
+	db2, err2 := strconv.Atoi(e.Argv[2])
+	if err1 != nil || err2 != nil {
+		return m.reject(e, "invalid SWAPDB command")
+	}
+	if db1 == db2 {
+		return nil // no effect
+	}
+	if m.cluster || m.foldDb {
+		return m.reject(e, "SWAPDB can not be applied to redis cluster or when fold_db is enabled")
+	}
+	target1, target2 := m.mapDb(db1), m.mapDb(db2)
+	if target1 == target2 || m.isShared(target1) || m.isShared(target2) {
+		return m.reject(e, "SWAPDB can not be applied to target dbs shared by several source dbs")
+	}
+	e.Argv = []string{e.Argv[0], strconv.Itoa(target1), strconv.Itoa(target2)}
+	return []*entry.Entry{e}
+}
+
+// applyMove translates "MOVE key db". When fold_db is enabled, it is turned
+// into "RENAMENX key newkey" in db 0, which also fails if the destination exists.
+func (m *dbMapper) applyMove(e *entry.Entry, sourceDbId int) []*entry.Entry {
+	if len(e.Argv) != 3 {
+		return m.reject(e, "invalid MOVE command")
+	}
+	destSourceDbId, err := strconv.Atoi(e.Argv[2])
+	if err != nil {
+		return m.reject(e, "invalid MOVE command")
+	}
+	srcDbId, srcPrefix := m.locate(sourceDbId)
+	dstDbId, dstPrefix := m.locate(destSourceDbId)
+	if srcDbId == dstDbId && srcPrefix == dstPrefix {
+		return nil // the key is already in place on the target
+	}
+	if srcDbId != dstDbId {
+		if m.cluster {
+			return m.reject(e, "MOVE can not be applied to redis cluster without fold_db")
+		}
+		e.DbId = srcDbId
+		e.Argv = []string{e.Argv[0], srcPrefix + e.Argv[1], strconv.Itoa(dstDbId)}
+		e.Parse()
+		return []*entry.Entry{e}
+	}
+	newEntry := entry.NewEntry()
+	newEntry.DbId = srcDbId
+	newEntry.Argv = []string{"RENAMENX", srcPrefix + e.Argv[1], dstPrefix + e.Argv[1]}
+	newEntry.Parse()
+	return []*entry.Entry{newEntry}
+}
+
+// applyCopy translates "COPY source destination [DB destination-db] [REPLACE]".
+func (m *dbMapper) applyCopy(e *entry.Entry, sourceDbId int) []*entry.Entry {
+	if len(e.Argv) < 3 {
+		return m.reject(e, "invalid COPY command")
+	}
+	destSourceDbId := sourceDbId
+	replace := false
+	for i := 3; i < len(e.Argv); i++ {
+		switch strings.ToUpper(e.Argv[i]) {
+		case "DB":
+			if i+1 >= len(e.Argv) {
+				return m.reject(e, "invalid COPY command")
+			}
+			var err error
+			destSourceDbId, err = strconv.Atoi(e.Argv[i+1])
+			if err != nil {
+				return m.reject(e, "invalid COPY command")
+			}
+			i++
+		case "REPLACE":
+			replace = true
+		default:
+			return m.reject(e, "invalid COPY command")
+		}
+	}
+	srcDbId, srcPrefix := m.locate(sourceDbId)
+	dstDbId, dstPrefix := m.locate(destSourceDbId)
+	if srcDbId != dstDbId && m.cluster {
+		return m.reject(e, "COPY with DB option can not be applied to redis cluster without fold_db")
+	}
+	argv := []string{e.Argv[0], srcPrefix + e.Argv[1], dstPrefix + e.Argv[2]}
+	if srcDbId != dstDbId {
+		argv = append(argv, "DB", strconv.Itoa(dstDbId))
+	}
+	if replace {
+		argv = append(argv, "REPLACE")
+	}
+	e.DbId = srcDbId
+	e.Argv = argv
+	e.Parse()
+	return []*entry.Entry{e}
+}
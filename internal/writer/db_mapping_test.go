@@ -0,0 +1,159 @@
+package writer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDbMapperFold(t *testing.T) {
+	m := newDbMapper(&RedisWriterOptions{
+		DbMapping:         map[string]int{"3": 0, "5": 1},
+		FoldDb:            true,
+		FoldDbPrefix:      "db%d:",
+		DbCommandBehavior: "skip",
+	})
+
+	e := newParsedEntry("SET", "key", "value")
+	e.DbId = 3
+	m.apply(e)
+	if e.DbId != 0 || strings.Join(e.Argv, " ") != "SET key value" {
+		t.Errorf("apply failed. db=%d, argv=%v", e.DbId, e.Argv)
+	}
+
+	e = newParsedEntry("MSET", "{user}a", "1", "{user}b", "2")
+	e.DbId = 5
+	slot := e.Slots[0]
+	m.apply(e)
+	if e.DbId != 0 || strings.Join(e.Argv, " ") != "MSET db1:{user}a 1 db1:{user}b 2" {
+		t.Errorf("apply failed. db=%d, argv=%v", e.DbId, e.Argv)
+	}
+	if e.Slots[0] != slot || e.Slots[1] != slot {
+		t.Errorf("apply should keep hash tag. slots=%v, want=%d", e.Slots, slot)
+	}
+
+	e = newParsedEntry("SET", "key", "value")
+	e.DbId = 7
+	m.apply(e)
+	if e.DbId != 0 || e.Keys[0] != "db7:key" {
+		t.Errorf("apply failed. db=%d, argv=%v", e.DbId, e.Argv)
+	}
+
+	// MOVE from db 3 (folded into db 0 without prefix) to db 7
+	e = newParsedEntry("MOVE", "key", "7")
+	e.DbId = 3
+	entries := m.apply(e)
+	if len(entries) != 1 || strings.Join(entries[0].Argv, " ") != "RENAMENX key db7:key" {
+		t.Errorf("apply(MOVE) failed. entries=%v", entries)
+	}
+
+	// FLUSHDB and SWAPDB can not be applied to folded dbs
+	e = newParsedEntry("FLUSHDB")
+	e.DbId = 7
+	if entries = m.apply(e); len(entries) != 0 {
+		t.Errorf("apply(FLUSHDB) should be rejected. entries=%v", entries)
+	}
+	e = newParsedEntry("SWAPDB", "1", "2")
+	if entries = m.apply(e); len(entries) != 0 {
+		t.Errorf("apply(SWAPDB) should be rejected. entries=%v", entries)
+	}
+}
+
+func TestDbMapperMapping(t *testing.T) {
+	m := newDbMapper(&RedisWriterOptions{
+		DbMapping:         map[string]int{"1": 10, "2": 10, "3": 4, "4": 6},
+		DbCommandBehavior: "skip",
+	})
+
+	e := newParsedEntry("SWAPDB", "3", "5")
+	entries := m.apply(e)
+	if len(entries) != 1 || strings.Join(entries[0].Argv, " ") != "SWAPDB 4 5" {
+		t.Errorf("apply(SWAPDB) failed. entries=%v", entries)
+	}
+	e = newParsedEntry("SWAPDB", "1", "5")
+	if entries = m.apply(e); len(entries) != 0 {
+		t.Errorf("apply(SWAPDB) to shared db should be rejected. entries=%v", entries)
+	}
+
+	e = newParsedEntry("MOVE", "key", "3")
+	e.DbId = 1
+	entries = m.apply(e)
+	if len(entries) != 1 || entries[0].DbId != 10 || strings.Join(entries[0].Argv, " ") != "MOVE key 4" {
+		t.Errorf("apply(MOVE) failed. entries=%v", entries)
+	}
+	e = newParsedEntry("MOVE", "key", "2")
+	e.DbId = 1
+	if entries = m.apply(e); len(entries) != 0 {
+		t.Errorf("apply(MOVE) to the same target db should be dropped. entries=%v", entries)
+	}
+
+	e = newParsedEntry("COPY", "a", "b", "DB", "3", "REPLACE")
+	e.DbId = 5
+	entries = m.apply(e)
+	if len(entries) != 1 || entries[0].DbId != 5 || strings.Join(entries[0].Argv, " ") != "COPY a b DB 4 REPLACE" {
+		t.Errorf("apply(COPY) failed. entries=%v", entries)
+	}
+
+	e = newParsedEntry("FLUSHDB")
+	e.DbId = 1
+	if entries = m.apply(e); len(entries) != 0 {
+		t.Errorf("apply(FLUSHDB) to shared db should be rejected. entries=%v", entries)
+	}
+	e = newParsedEntry("FLUSHDB")
+	e.DbId = 3
+	if entries = m.apply(e); len(entries) != 1 || entries[0].DbId != 4 {
+		t.Errorf("apply(FLUSHDB) failed. entries=%v", entries)
+	}
+
+	e = newParsedEntry("EVAL", "redis.call('select', 1) return 1", "0")
+	if entries = m.apply(e); len(entries) != 0 {
+		t.Errorf("apply(EVAL) with select should be rejected. entries=%v", entries)
+	}
+}
+
+func TestDbMapperFlushAll(t *testing.T) {
+	// fold_db: all the source dbs are in db 0
+	m := newDbMapper(&RedisWriterOptions{FoldDb: true, FoldDbPrefix: "db%d:", DbCommandBehavior: "skip"})
+	e := newParsedEntry("FLUSHALL", "ASYNC")
+	e.DbId = 3
+	if entries := m.apply(e); len(entries) != 1 || entries[0].DbId != 0 || strings.Join(entries[0].Argv, " ") != "FLUSHDB ASYNC" {
+		t.Errorf("apply(FLUSHALL) with fold_db failed. entries=%v", entries)
+	}
+
+	// target db 3 is not written by any source db
+	m = newDbMapper(&RedisWriterOptions{DbMapping: map[string]int{"3": 0}, DbCommandBehavior: "skip"})
+	if entries := m.apply(newParsedEntry("FLUSHALL")); len(entries) != 0 {
+		t.Errorf("apply(FLUSHALL) should be rejected. entries=%v", entries)
+	}
+	m = newDbMapper(&RedisWriterOptions{DbMapping: map[string]int{"3": 4, "4": 3}, DbCommandBehavior: "skip"})
+	if entries := m.apply(newParsedEntry("FLUSHALL")); len(entries) != 1 {
+		t.Errorf("apply(FLUSHALL) failed. entries=%v", entries)
+	}
+}
+
+func TestDbMapperCluster(t *testing.T) {
+	// commands of other dbs are rejected by a cluster target without db_mapping and fold_db
+	m := newDbMapper(&RedisWriterOptions{Cluster: true, DbCommandBehavior: "skip"})
+	for _, argv := range [][]string{{"MOVE", "key", "1"}, {"SWAPDB", "0", "1"}, {"COPY", "a", "b", "DB", "1"}} {
+		if entries := m.apply(newParsedEntry(argv...)); len(entries) != 0 {
+			t.Errorf("apply(%v) should be rejected. entries=%v", argv, entries)
+		}
+	}
+	if entries := m.apply(newParsedEntry("SET", "key", "value")); len(entries) != 1 {
+		t.Errorf("apply(SET) failed. entries=%v", entries)
+	}
+}
+
+func TestDbMapperClusterNode(t *testing.T) {
+	// entries mapped by the cluster writer are not mapped again by the node writers
+	opts := &RedisWriterOptions{Cluster: true, FoldDb: true, FoldDbPrefix: "db%d:", DbCommandBehavior: "panic"}
+	m, node := newDbMapper(opts), newDbMapper(nodeWriterOptions(opts, "127.0.0.1:7000"))
+	for _, argv := range [][]string{{"SET", "key", "value"}, {"COPY", "a", "b", "DB", "1"}, {"FLUSHALL"}} {
+		e := newParsedEntry(argv...)
+		e.DbId = 1
+		for _, mapped := range m.apply(e) {
+			if entries := node.apply(mapped); len(entries) != 1 || entries[0] != mapped {
+				t.Errorf("apply(%v) is mapped again by the node writer. entries=%v", mapped.Argv, entries)
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package writer
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	flowMinWindow     = 16
+	flowInitWindow    = 128
+	flowQueueLow      = 8  // increase window if fewer entries are estimated to be queued at target
+	flowQueueHigh     = 32 // decrease window if more entries are estimated to be queued at target
+	flowMinRttRefresh = 30 * time.Second
+)
+
+// flowControl limits the entries and bytes in flight, i.e. sent to the target
+// but not replied yet. The bytes limit is fixed, while the entries limit
+// (window) adapts to the observed reply latency: the window grows while the
+// latency stays close to the minimal round trip time, and shrinks when
+// entries start to queue at the target, like TCP Vegas.
+type flowControl struct {
+	lock sync.Mutex
+	cond *sync.Cond
+
+	maxBytes  int64
+	maxWindow float64
+	window    float64
+
+	inflightBytes   int64
+	inflightEntries int64
+
+	srtt            time.Duration // smoothed reply latency
+	minRtt          time.Duration
+	minRttUpdatedAt time.Time
+}
+
+type flowStat struct {
+	InflightBytes   int64
+	InflightEntries int64
+	Window          int64
+	SrttUs          int64
+	MinRttUs        int64
+}
+
+func newFlowControl(maxBytes int64, maxWindow uint64) *flowControl {
+	f := new(flowControl)
+	f.cond = sync.NewCond(&f.lock)
+	f.maxBytes = maxBytes
+	f.maxWindow = math.Max(float64(maxWindow), 1)
+	f.window = math.Min(flowInitWindow, f.maxWindow)
+	return f
+}
+
+// acquire blocks until an entry of size bytes can be sent. An entry larger
+// than the bytes limit is sent once nothing else is in flight.
+func (f *flowControl) acquire(size int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for f.inflightEntries > 0 &&
+		(f.inflightBytes+size > f.maxBytes || float64(f.inflightEntries) >= f.window) {
+		f.cond.Wait()
+	}
+	f.inflightBytes += size
+	f.inflightEntries += 1
+}
+
+// release is called when the reply of an entry is received.
+func (f *flowControl) release(size int64, latency time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.inflightBytes -= size
+	f.inflightEntries -= 1
+	f.adapt(latency)
+	f.cond.Broadcast()
+}
+
+func (f *flowControl) adapt(latency time.Duration) {
+	now := time.Now()
+	if f.minRtt == 0 || latency < f.minRtt || now.Sub(f.minRttUpdatedAt) > flowMinRttRefresh {
+		f.minRtt = latency
+		f.minRttUpdatedAt = now
+	}
+	if f.srtt == 0 {
+		f.srtt = latency
+	} else {
+		f.srtt = (7*f.srtt + latency) / 8
+	}
+	if f.srtt <= 0 {
+		return
+	}
+	queued := f.window * (1 - float64(f.minRtt)/float64(f.srtt))
+	if queued < flowQueueLow {
+		f.window += 1
+	} else if queued > flowQueueHigh {
+		f.window -= 0.5
+	}
+	f.window = math.Max(math.Min(f.window, f.maxWindow), math.Min(flowMinWindow, f.maxWindow))
+}
+
+// waitEmpty blocks until nothing is in flight.
+func (f *flowControl) waitEmpty() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for f.inflightEntries > 0 {
+		f.cond.Wait()
+	}
+}
+
+func (f *flowControl) isEmpty() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.inflightEntries == 0 && f.inflightBytes == 0
+}
+
+func (f *flowControl) stat() flowStat {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return flowStat{
+		InflightBytes:   f.inflightBytes,
+		InflightEntries: f.inflightEntries,
+		Window:          int64(f.window),
+		SrttUs:          f.srtt.Microseconds(),
+		MinRttUs:        f.minRtt.Microseconds(),
+	}
+}
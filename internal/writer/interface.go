@@ -8,5 +8,6 @@ import (
 type Writer interface {
 	status.Statusable
 	Write(entry *entry.Entry)
+	Flush() // wait until all the written entries are replied
 	Close()
 }
@@ -1,6 +1,8 @@
 package writer
 
 import (
+	"RedisShake/internal/client"
+	"RedisShake/internal/deadletter"
 	"RedisShake/internal/entry"
 	"RedisShake/internal/log"
 	"RedisShake/internal/utils"
@@ -10,19 +12,38 @@ const KeySlots = 16384
 
 type RedisClusterWriter struct {
 	addresses []string
-	writers   []Writer
-	router    [KeySlots]Writer
+	writers   []*redisNodeWriter
+	router    [KeySlots]*redisNodeWriter
+
+	// for commands that copy keys across slots
+	opts          *RedisWriterOptions
+	routerAddress [KeySlots]string
+	clients       map[string]*client.Redis
+
+	crossSlotBehavior string
+	dbMapper          *dbMapper
 
 	stat []interface{}
 }
 
 func NewRedisClusterWriter(opts *RedisWriterOptions) Writer {
 	rw := new(RedisClusterWriter)
+	deadletter.CheckBehavior("cross_slot_behavior", opts.CrossSlotBehavior)
+	rw.crossSlotBehavior = opts.CrossSlotBehavior
+	rw.dbMapper = newDbMapper(opts)
+	rw.opts = opts
+	rw.clients = make(map[string]*client.Redis)
 	rw.loadClusterNodes(opts)
 	log.Infof("redisClusterWriter connected to redis cluster successful. addresses=%v", rw.addresses)
 	return rw
 }
 
+func (r *RedisClusterWriter) Flush() {
+	for _, writer := range r.writers {
+		writer.Flush()
+	}
+}
+
 func (r *RedisClusterWriter) Close() {
 	for _, writer := range r.writers {
 		writer.Close()
@@ -33,15 +54,14 @@ func (r *RedisClusterWriter) loadClusterNodes(opts *RedisWriterOptions) {
 	addresses, slots := utils.GetRedisClusterNodes(opts.Address, opts.Username, opts.Password, opts.Tls)
 	r.addresses = addresses
 	for i, address := range addresses {
-		theOpts := *opts
-		theOpts.Address = address
-		redisWriter := NewRedisStandaloneWriter(&theOpts)
+		redisWriter := newRedisNodeWriter(nodeWriterOptions(opts, address))
 		r.writers = append(r.writers, redisWriter)
 		for _, s := range slots[i] {
 			if r.router[s] != nil {
 				log.Panicf("redisClusterWriter: slot %d already occupied", s)
 			}
 			r.router[s] = redisWriter
+			r.routerAddress[s] = address
 		}
 	}
 
@@ -52,7 +72,28 @@ func (r *RedisClusterWriter) loadClusterNodes(opts *RedisWriterOptions) {
 	}
 }
 
-func (r *RedisClusterWriter) Write(entry *entry.Entry) {
+// nodeWriterOptions returns the options of the writer of a cluster node.
+// The entries are mapped by the cluster writer, so the node writer does not
+// map them again, including the db commands handled for a cluster target.
+func nodeWriterOptions(opts *RedisWriterOptions, address string) *RedisWriterOptions {
+	theOpts := *opts
+	theOpts.Address = address
+	theOpts.Cluster = false
+	theOpts.DbMapping = nil
+	theOpts.FoldDb = false
+	return &theOpts
+}
+
+func (r *RedisClusterWriter) Write(e *entry.Entry) {
+	for _, entry := range r.dbMapper.apply(e) {
+		if entry.DbId != 0 {
+			log.Panicf("redisClusterWriter: redis cluster only supports db 0, set db_mapping or fold_db for db %d. cmd=[%s]", entry.DbId, entry.String())
+		}
+		r.write(entry)
+	}
+}
+
+func (r *RedisClusterWriter) write(entry *entry.Entry) {
 	if len(entry.Slots) == 0 {
 		for _, writer := range r.writers {
 			writer.Write(entry)
@@ -60,16 +101,22 @@ func (r *RedisClusterWriter) Write(entry *entry.Entry) {
 		return
 	}
 
-	lastSlot := -1
-	for _, slot := range entry.Slots {
-		if lastSlot == -1 {
-			lastSlot = slot
+	if !isSameSlot(entry.Slots) {
+		entries := splitCrossSlotEntry(entry)
+		if entries == nil {
+			if r.copyAcrossSlots(entry) {
+				return
+			}
+			deadletter.Reject(r.crossSlotBehavior, entry, "CROSSSLOT Keys in request don't hash to the same slot")
+			return
 		}
-		if slot != lastSlot {
-			log.Panicf("CROSSSLOT Keys in request don't hash to the same slot. argv=%v", entry.Argv)
+		log.Debugf("redisClusterWriter split cross slot command into %d commands. cmd=[%s]", len(entries), entry.String())
+		for _, e := range entries {
+			r.router[e.Slots[0]].Write(e)
 		}
+		return
 	}
-	r.router[lastSlot].Write(entry)
+	r.router[entry.Slots[0]].Write(entry)
 }
 
 func (r *RedisClusterWriter) Consistent() bool {
@@ -0,0 +1,127 @@
+package writer
+
+import (
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"fmt"
+	"strings"
+)
+
+// redisNodeWriter writes to one redis node through several connections.
+// Entries are sharded by key slot, so the commands on the same key are sent
+// on the same connection and keep their order. Keyless commands, commands
+// whose keys belong to different connections and transactions are sent on
+// the first connection after all the other connections are replied, and the
+// other connections wait for them to be replied before sending again.
+type redisNodeWriter struct {
+	conns []*redisStandaloneWriter
+
+	inTransaction bool
+	// the connection that sent the last serialized command, the other
+	// connections must wait for its reply before sending
+	serialConn *redisStandaloneWriter
+}
+
+func newRedisNodeWriter(opts *RedisWriterOptions) *redisNodeWriter {
+	if opts.ConnectionsPerNode < 1 {
+		log.Panicf("connections_per_node must be greater than 0. connections_per_node=[%d]", opts.ConnectionsPerNode)
+	}
+	w := new(redisNodeWriter)
+	for i := 0; i < opts.ConnectionsPerNode; i++ {
+		conn := newRedisStandaloneWriter(opts)
+		if opts.ConnectionsPerNode > 1 {
+			conn.stat.Name = fmt.Sprintf("%s_conn%d", conn.stat.Name, i)
+		}
+		w.conns = append(w.conns, conn)
+	}
+	return w
+}
+
+func (w *redisNodeWriter) Write(e *entry.Entry) {
+	if len(w.conns) == 1 {
+		w.conns[0].Write(e)
+		return
+	}
+
+	conn := w.shard(e)
+	if conn == nil {
+		// serialize the command across connections
+		conn = w.conns[0]
+		if w.serialConn != conn {
+			w.waitReplied()
+		}
+		w.serialConn = conn
+	} else if w.serialConn != nil && w.serialConn != conn {
+		w.serialConn.waitReplied()
+		w.serialConn = nil
+	}
+	conn.Write(e)
+}
+
+// shard returns the connection of the entry, or nil if the entry needs to be
+// serialized across connections.
+func (w *redisNodeWriter) shard(e *entry.Entry) *redisStandaloneWriter {
+	switch e.CmdName {
+	case "MULTI":
+		w.inTransaction = true
+		return nil
+	case "EXEC", "DISCARD":
+		w.inTransaction = false
+		return nil
+	}
+	if w.inTransaction || len(e.Slots) == 0 {
+		return nil
+	}
+	index := e.Slots[0] % len(w.conns)
+	for _, slot := range e.Slots[1:] {
+		if slot%len(w.conns) != index {
+			return nil
+		}
+	}
+	return w.conns[index]
+}
+
+// waitReplied waits until all the connections are replied.
+func (w *redisNodeWriter) waitReplied() {
+	for _, conn := range w.conns {
+		conn.waitReplied()
+	}
+}
+
+func (w *redisNodeWriter) Flush() {
+	w.waitReplied()
+}
+
+func (w *redisNodeWriter) Close() {
+	for _, conn := range w.conns {
+		conn.Close()
+	}
+}
+
+func (w *redisNodeWriter) Status() interface{} {
+	if len(w.conns) == 1 {
+		return w.conns[0].Status()
+	}
+	stat := make([]interface{}, 0, len(w.conns))
+	for _, conn := range w.conns {
+		stat = append(stat, conn.Status())
+	}
+	return stat
+}
+
+func (w *redisNodeWriter) StatusString() string {
+	strs := make([]string, 0, len(w.conns))
+	for _, conn := range w.conns {
+		strs = append(strs, conn.StatusString())
+	}
+	return strings.Join(strs, ", ")
+}
+
+func (w *redisNodeWriter) StatusConsistent() bool {
+	for _, conn := range w.conns {
+		if !conn.StatusConsistent() {
+			return false
+		}
+	}
+	return true
+}
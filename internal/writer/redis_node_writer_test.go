@@ -0,0 +1,38 @@
+package writer
+
+import (
+	"testing"
+)
+
+func TestRedisNodeWriterShard(t *testing.T) {
+	w := &redisNodeWriter{conns: []*redisStandaloneWriter{{}, {}, {}, {}}}
+
+	// the same key is always sent on the same connection
+	conn := w.shard(newParsedEntry("SET", "{a}1", "v"))
+	if conn == nil || w.shard(newParsedEntry("DEL", "{a}1", "{a}2")) != conn {
+		t.Errorf("shard failed. commands on the same slot are sent on different connections")
+	}
+
+	// keyless commands and keys on different connections are serialized
+	if w.shard(newParsedEntry("FLUSHALL")) != nil {
+		t.Errorf("shard failed. keyless command is not serialized")
+	}
+	var other string
+	for _, key := range []string{"{b}1", "{c}1", "{d}1", "{e}1"} {
+		if w.shard(newParsedEntry("GET", key)) != conn {
+			other = key
+			break
+		}
+	}
+	if w.shard(newParsedEntry("MSET", "{a}1", "v", other, "v")) != nil {
+		t.Errorf("shard failed. keys on different connections are not serialized")
+	}
+
+	// transactions are serialized
+	if w.shard(newParsedEntry("MULTI")) != nil || w.shard(newParsedEntry("SET", "{a}1", "v")) != nil || w.shard(newParsedEntry("EXEC")) != nil {
+		t.Errorf("shard failed. transaction is not serialized")
+	}
+	if w.shard(newParsedEntry("SET", "{a}1", "v")) != conn {
+		t.Errorf("shard failed. commands after transaction are not sharded")
+	}
+}
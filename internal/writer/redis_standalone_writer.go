@@ -1,6 +1,7 @@
 package writer
 
 import (
+	"RedisShake/internal/bidirectional"
 	"RedisShake/internal/client"
 	"RedisShake/internal/client/proto"
 	"RedisShake/internal/config"
@@ -20,101 +21,351 @@ type RedisWriterOptions struct {
 	Username string `mapstructure:"username" default:""`
 	Password string `mapstructure:"password" default:""`
 	Tls      bool   `mapstructure:"tls" default:"false"`
+	// RESP version to talk to the target, 2 or 3. 3 requires Redis 6.0+.
+	Protocol int `mapstructure:"protocol" default:"2"`
+
+	// Number of connections to each target node. Commands are sharded by key
+	// slot, so the commands on the same key keep their order. Commands without
+	// keys or with keys on different connections wait for all the connections.
+	ConnectionsPerNode int `mapstructure:"connections_per_node" default:"1"`
+
+	// Multi-key commands like MSET, DEL, UNLINK and TOUCH whose keys hash to
+	// different slots are split into one command per slot. This item decides
+	// what to do with the other cross slot commands when target is a cluster:
+	// panic, skip or dead_letter.
+	CrossSlotBehavior string `mapstructure:"cross_slot_behavior" default:"panic"`
+
+	// Map source db to target db, e.g. {"3" = 0}. Unlisted dbs are not changed.
+	DbMapping map[string]int `mapstructure:"db_mapping"`
+	// Write keys of non-zero dbs (after db_mapping) to db 0 with a key prefix,
+	// "%d" in fold_db_prefix is replaced by the db id. Redis cluster only has db 0.
+	FoldDb       bool   `mapstructure:"fold_db" default:"false"`
+	FoldDbPrefix string `mapstructure:"fold_db_prefix" default:"db%d:"`
+	// SWAPDB, MOVE, COPY ... DB and FLUSHDB are translated according to
+	// db_mapping and fold_db. This item decides what to do with the ones that
+	// can not be translated: panic, skip or dead_letter.
+	DbCommandBehavior string `mapstructure:"db_command_behavior" default:"panic"`
+
+	// Commands the target does not know because of its version, e.g. GETEX,
+	// LMPOP or EXPIRE with options on 6.x, are translated into equivalent
+	// commands or lua scripts. This item decides what to do with the ones that
+	// can not be translated: panic, skip or dead_letter.
+	UnsupportedCommandBehavior string `mapstructure:"unsupported_command_behavior" default:"panic"`
+
+	// Durability barrier. redis-shake sends WAIT (barrier_mode = "wait") or
+	// WAITAOF (barrier_mode = "waitaof", Redis 7.2+) to the target every
+	// barrier_interval milliseconds, and advances the durable offset only after
+	// barrier_replicas replicas (and the local AOF if barrier_aof_local is true)
+	// acknowledged the previous writes within barrier_timeout milliseconds.
+	BarrierMode     string `mapstructure:"barrier_mode" default:""`
+	BarrierReplicas int    `mapstructure:"barrier_replicas" default:"1"`
+	BarrierAOFLocal bool   `mapstructure:"barrier_aof_local" default:"false"`
+	BarrierTimeout  int    `mapstructure:"barrier_timeout" default:"1000"`
+	BarrierInterval int    `mapstructure:"barrier_interval" default:"1000"`
+}
+
+type pendingEntry struct {
+	e       *entry.Entry
+	sentAt  time.Time
+	wrapped bool // sent with the marker of bidirectional sync
 }
 
 type redisStandaloneWriter struct {
 	address string
+	opts    *RedisWriterOptions
 	client  *client.Redis
 	DbId    int
 
-	chWaitReply chan *entry.Entry
+	dbMapper   *dbMapper
+	translator *commandTranslator
+
+	loadedScripts map[string]bool // sha1 of the scripts sent on this connection
+	inTransaction bool            // inside a MULTI from the source
+
+	sendLock    sync.Mutex
+	closed      bool
+	flow        *flowControl
+	chWaitReply chan *pendingEntry
 	chWg        sync.WaitGroup
 
+	// entries in chWaitReply or waiting for reply, including select and barrier
+	inflightLock sync.Mutex
+	inflightCond *sync.Cond
+	inflight     int64
+
+	sentOffset    int64 // entries sent to the target
+	durableOffset int64 // entries confirmed by the durability barrier
+
+	// retry on transient errors
+	paused         int32 // sending is paused until retryEntries are sent again
+	resumeCond     *sync.Cond
+	retryLock      sync.Mutex
+	retryCond      *sync.Cond // broadcast when sending is resumed
+	retryEntries   []*entry.Entry
+	retryScheduled bool
+	retryBackoff   int64 // in nanoseconds
+	// replied entries of the source transaction not executed yet, and whether
+	// the rest of the transaction is aborted by a retryable error. Only
+	// accessed by processReply, and by retry when nothing is in flight.
+	repliedTransaction []*entry.Entry
+	abortedTransaction bool
+
+	// durability barrier
+	barrierTicker *time.Ticker
+	barrierLock   sync.Mutex
+	barriers      []barrier
+
+	// RetryingError, RetryingEntries and RetryCount are guarded by retryLock,
+	// the others are filled in by Status.
 	stat struct {
 		Name              string `json:"name"`
 		UnansweredBytes   int64  `json:"unanswered_bytes"`
 		UnansweredEntries int64  `json:"unanswered_entries"`
+		PipelineWindow    int64  `json:"pipeline_window"` // adaptive limit of unanswered entries
+		ReplyLatencyUs    int64  `json:"reply_latency_us"`
+		MinReplyLatencyUs int64  `json:"min_reply_latency_us"`
+		SentOffset        int64  `json:"sent_offset"`      // entries sent to the target
+		DurableOffset     int64  `json:"durable_offset"`   // entries confirmed by the durability barrier
+		RetryingError     string `json:"retrying_error"`   // the transient error that paused sending
+		RetryingEntries   int64  `json:"retrying_entries"` // entries waiting to be sent again
+		RetryCount        int64  `json:"retry_count"`      // entries sent again in total
 	}
 }
 
 func NewRedisStandaloneWriter(opts *RedisWriterOptions) Writer {
+	return newRedisNodeWriter(opts)
+}
+
+// newRedisStandaloneWriter creates a writer with a single connection.
+func newRedisStandaloneWriter(opts *RedisWriterOptions) *redisStandaloneWriter {
 	rw := new(redisStandaloneWriter)
 	rw.address = opts.Address
+	rw.opts = opts
+	rw.resumeCond = sync.NewCond(&rw.sendLock)
+	rw.retryCond = sync.NewCond(&rw.retryLock)
+	rw.inflightCond = sync.NewCond(&rw.inflightLock)
 	rw.stat.Name = "writer_" + strings.Replace(opts.Address, ":", "_", -1)
-	rw.client = client.NewRedisClient(opts.Address, opts.Username, opts.Password, opts.Tls)
-	rw.chWaitReply = make(chan *entry.Entry, config.Opt.Advanced.PipelineCountLimit)
+	rw.client = client.NewRedisClientWithProtocol(opts.Address, opts.Username, opts.Password, opts.Tls, opts.Protocol)
+	rw.dbMapper = newDbMapper(opts)
+	rw.loadedScripts = make(map[string]bool)
+	rw.translator = newCommandTranslator(rw.client.ServerVersion(), opts.UnsupportedCommandBehavior)
+	checkBarrierMode(opts.BarrierMode)
+	rw.flow = newFlowControl(config.Opt.Advanced.TargetRedisClientMaxQuerybufLen, config.Opt.Advanced.PipelineCountLimit)
+	// select and barrier commands are not limited by flow control, so leave some room for them
+	rw.chWaitReply = make(chan *pendingEntry, 2*config.Opt.Advanced.PipelineCountLimit+16)
 	rw.chWg.Add(1)
 	go rw.processReply()
+	rw.startBarrier()
 	return rw
 }
 
 func (w *redisStandaloneWriter) Close() {
+	if w.barrierTicker != nil {
+		w.barrierTicker.Stop()
+	}
+	w.waitReplied()
+	w.sendLock.Lock()
+	if w.opts.BarrierMode != barrierModeNone {
+		w.sendBarrierIfNeeded()
+	}
+	w.closed = true
 	close(w.chWaitReply)
+	w.sendLock.Unlock()
 	w.chWg.Wait()
 }
 
 func (w *redisStandaloneWriter) Write(e *entry.Entry) {
+	w.sendLock.Lock()
+	defer w.sendLock.Unlock()
+	for atomic.LoadInt32(&w.paused) == 1 {
+		w.resumeCond.Wait()
+	}
+	for _, mapped := range w.dbMapper.apply(e) {
+		for _, entry := range w.translator.translate(mapped) {
+			w.write(entry)
+		}
+	}
+}
+
+func (w *redisStandaloneWriter) write(e *entry.Entry) {
+	w.prepareScript(e)
+
 	// switch db if we need
 	if w.DbId != e.DbId {
 		w.switchDbTo(e.DbId)
 	}
 
 	// send
+	switch e.CmdName {
+	case "MULTI":
+		w.inTransaction = true
+	case "EXEC", "DISCARD":
+		w.inTransaction = false
+	}
 	bytes := e.Serialize()
-	for e.SerializedSize+atomic.LoadInt64(&w.stat.UnansweredBytes) > config.Opt.Advanced.TargetRedisClientMaxQuerybufLen {
-		time.Sleep(1 * time.Nanosecond)
+	wrapped := w.needMarker(e)
+	if wrapped {
+		bytes = wrapWithMarker(bytes)
 	}
+	w.flow.acquire(e.SerializedSize)
 	log.Debugf("[%s] send cmd. cmd=[%s]", w.stat.Name, e.String())
-	w.chWaitReply <- e
-	atomic.AddInt64(&w.stat.UnansweredBytes, e.SerializedSize)
-	atomic.AddInt64(&w.stat.UnansweredEntries, 1)
+	w.addInflight(1)
+	w.chWaitReply <- &pendingEntry{e: e, sentAt: time.Now(), wrapped: wrapped}
+	atomic.AddInt64(&w.sentOffset, 1)
 	w.client.SendBytes(bytes)
+
+	if e.CmdName == "MULTI" && bidirectional.Enabled() {
+		w.write(newMarkerEntry(e.DbId))
+	}
+}
+
+// enqueue hands the entry over to processReply to wait for its reply.
+func (w *redisStandaloneWriter) enqueue(e *entry.Entry) {
+	w.addInflight(1)
+	w.chWaitReply <- &pendingEntry{e: e, sentAt: time.Now()}
+}
+
+func (w *redisStandaloneWriter) addInflight(delta int64) {
+	w.inflightLock.Lock()
+	defer w.inflightLock.Unlock()
+	w.inflight += delta
+	if w.inflight == 0 {
+		w.inflightCond.Broadcast()
+	}
+}
+
+// waitNoInflight blocks until all the entries handed over to processReply
+// are handled.
+func (w *redisStandaloneWriter) waitNoInflight() {
+	w.inflightLock.Lock()
+	defer w.inflightLock.Unlock()
+	for w.inflight != 0 {
+		w.inflightCond.Wait()
+	}
 }
 
 func (w *redisStandaloneWriter) switchDbTo(newDbId int) {
 	log.Debugf("[%s] switch db to [%d]", w.stat.Name, newDbId)
 	w.client.Send("select", strconv.Itoa(newDbId))
 	w.DbId = newDbId
-	w.chWaitReply <- &entry.Entry{
+	w.enqueue(&entry.Entry{
 		Argv:    []string{"select", strconv.Itoa(newDbId)},
 		CmdName: "select",
-	}
+	})
 }
 
 func (w *redisStandaloneWriter) processReply() {
-	for e := range w.chWaitReply {
-		reply, err := w.client.Receive()
-		log.Debugf("[%s] receive reply. reply=[%v], cmd=[%s]", w.stat.Name, reply, e.String())
-		if err == proto.Nil {
-			log.Warnf("[%s] receive nil reply. cmd=[%s]", w.stat.Name, e.String())
-		} else if err != nil {
-			if err.Error() == "BUSYKEY Target key name already exists." {
-				if config.Opt.Advanced.RDBRestoreCommandBehavior == "skip" {
-					log.Debugf("[%s] redisStandaloneWriter received BUSYKEY reply. cmd=[%s]", w.stat.Name, e.String())
-				} else if config.Opt.Advanced.RDBRestoreCommandBehavior == "panic" {
-					log.Panicf("[%s] redisStandaloneWriter received BUSYKEY reply. cmd=[%s]", w.stat.Name, e.String())
-				}
-			} else {
-				log.Panicf("[%s] receive reply failed. cmd=[%s], error=[%v]", w.stat.Name, e.String(), err)
+	for p := range w.chWaitReply {
+		var reply interface{}
+		var err error
+		if p.wrapped {
+			reply, err = w.receiveWrappedReply()
+		} else {
+			reply, err = w.client.Receive()
+		}
+		log.Debugf("[%s] receive reply. reply=[%v], cmd=[%s]", w.stat.Name, reply, p.e.String())
+		w.handleReply(p, reply, err)
+		w.addInflight(-1)
+	}
+	w.chWg.Done()
+}
+
+func (w *redisStandaloneWriter) handleReply(p *pendingEntry, reply interface{}, err error) {
+	e := p.e
+	if b, ok := w.popBarrier(e); ok {
+		w.processBarrierReply(b, reply, err)
+		return
+	}
+	if strings.EqualFold(e.CmdName, "select") { // skip select command
+		if err != nil && !isRetryableError(err) {
+			log.Panicf("[%s] select db failed. cmd=[%s], error=[%v]", w.stat.Name, e.String(), err)
+		}
+		return
+	}
+	if e.CmdName == "discard" { // discard the transaction before retry
+		return
+	}
+	// released after the entry is handled, so that waitReplied does not
+	// return before the retry it schedules
+	latency := time.Since(p.sentAt)
+	defer w.flow.release(e.SerializedSize, latency)
+	if w.queueAbortedTransaction(e) {
+		return
+	}
+	if err == proto.Nil {
+		log.Warnf("[%s] receive nil reply. cmd=[%s]", w.stat.Name, e.String())
+	} else if err != nil {
+		if err.Error() == "BUSYKEY Target key name already exists." {
+			if config.Opt.Advanced.RDBRestoreCommandBehavior == "skip" {
+				log.Debugf("[%s] redisStandaloneWriter received BUSYKEY reply. cmd=[%s]", w.stat.Name, e.String())
+			} else if config.Opt.Advanced.RDBRestoreCommandBehavior == "panic" {
+				log.Panicf("[%s] redisStandaloneWriter received BUSYKEY reply. cmd=[%s]", w.stat.Name, e.String())
 			}
+		} else if e.CmdName == "RESTORE" && isRestorePayloadError(err) {
+			w.translator.enableRestoreRewrite()
+			w.resendLater(w.translator.rewriteRestore(e), err)
+			return
+		} else if errorClass(err) == "NOSCRIPT" && w.reloadScript(e, err) {
+			return
+		} else if isRetryableError(err) {
+			w.scheduleRetry(e, err)
+			return
+		} else if w.translator.isUnsupportedError(err) {
+			w.translator.reject(e, "target does not support the command, error=["+err.Error()+"]")
+		} else {
+			log.Panicf("[%s] receive reply failed. cmd=[%s], error=[%v]", w.stat.Name, e.String(), err)
 		}
-		if strings.EqualFold(e.CmdName, "select") { // skip select command
-			continue
+	}
+	w.trackTransaction(e)
+	atomic.StoreInt64(&w.retryBackoff, 0)
+}
+
+// waitReplied waits until all the sent entries are replied, including the
+// entries sent again after transient errors.
+func (w *redisStandaloneWriter) waitReplied() {
+	for {
+		w.flow.waitEmpty()
+		w.retryLock.Lock()
+		for atomic.LoadInt32(&w.paused) == 1 {
+			w.retryCond.Wait()
+		}
+		w.retryLock.Unlock()
+		// the entries sent again may be in flight
+		if w.flow.isEmpty() {
+			return
 		}
-		atomic.AddInt64(&w.stat.UnansweredBytes, -e.SerializedSize)
-		atomic.AddInt64(&w.stat.UnansweredEntries, -1)
 	}
-	w.chWg.Done()
 }
 
 func (w *redisStandaloneWriter) Status() interface{} {
-	return w.stat
+	w.retryLock.Lock()
+	stat := w.stat
+	w.retryLock.Unlock()
+	flowStat := w.flow.stat()
+	stat.UnansweredBytes = flowStat.InflightBytes
+	stat.UnansweredEntries = flowStat.InflightEntries
+	stat.PipelineWindow = flowStat.Window
+	stat.ReplyLatencyUs = flowStat.SrttUs
+	stat.MinReplyLatencyUs = flowStat.MinRttUs
+	stat.SentOffset = atomic.LoadInt64(&w.sentOffset)
+	stat.DurableOffset = atomic.LoadInt64(&w.durableOffset)
+	return stat
 }
 
 func (w *redisStandaloneWriter) StatusString() string {
-	return fmt.Sprintf("[%s]: unanswered_entries=%d", w.stat.Name, atomic.LoadInt64(&w.stat.UnansweredEntries))
+	flowStat := w.flow.stat()
+	w.retryLock.Lock()
+	retrying, retryingError := w.retryScheduled, w.stat.RetryingError
+	w.retryLock.Unlock()
+	if retrying {
+		return fmt.Sprintf("[%s]: unanswered_entries=%d, retrying_error=[%s]", w.stat.Name, flowStat.InflightEntries, retryingError)
+	}
+	return fmt.Sprintf("[%s]: unanswered_entries=%d, pipeline_window=%d", w.stat.Name, flowStat.InflightEntries, flowStat.Window)
 }
 
 func (w *redisStandaloneWriter) StatusConsistent() bool {
-	return atomic.LoadInt64(&w.stat.UnansweredBytes) == 0 && atomic.LoadInt64(&w.stat.UnansweredEntries) == 0
+	if w.opts.BarrierMode != barrierModeNone && atomic.LoadInt64(&w.durableOffset) != atomic.LoadInt64(&w.sentOffset) {
+		return false
+	}
+	return w.flow.isEmpty() && !w.isRetrying()
 }
@@ -0,0 +1,69 @@
+package writer
+
+import (
+	"RedisShake/internal/config"
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"RedisShake/internal/rdb/types"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// restorePayloadError is replied by targets that can not load the DUMP
+// payload, e.g. a payload of a newer RDB version.
+const restorePayloadError = "ERR DUMP payload version or checksum are wrong"
+
+func isRestorePayloadError(err error) bool {
+	return strings.HasPrefix(err.Error(), restorePayloadError)
+}
+
+// enableRestoreRewrite makes the translator rewrite all the following
+// RESTORE commands into type-native commands.
+func (t *commandTranslator) enableRestoreRewrite() {
+	if atomic.CompareAndSwapInt32(&t.restoreRewrite, 0, 1) {
+		log.Warnf("target can not load DUMP payload, fall back to load keys with type-native commands")
+	}
+}
+
+// rewriteRestore turns "RESTORE key ttl payload [REPLACE] [ABSTTL] [IDLETIME seconds]
+// [FREQ frequency]" into type-native commands by parsing the payload.
+func (t *commandTranslator) rewriteRestore(e *entry.Entry) []*entry.Entry {
+	if len(e.Argv) < 4 || len(e.Argv[3]) < 11 {
+		return t.reject(e, "invalid RESTORE command")
+	}
+	key, payload := e.Argv[1], e.Argv[3]
+	ttl, err := strconv.ParseInt(e.Argv[2], 10, 64)
+	if err != nil {
+		return t.reject(e, "invalid RESTORE command")
+	}
+	replace := false
+	for _, option := range e.Argv[4:] {
+		switch strings.ToUpper(option) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			if ttl != 0 {
+				if ttl -= time.Now().UnixMilli(); ttl <= 0 {
+					ttl = 1
+				}
+			}
+		}
+	}
+	if !replace {
+		replace = config.Opt.Advanced.RDBRestoreCommandBehavior == "rewrite"
+	}
+
+	// payload: type byte, value, 2 bytes RDB version and 8 bytes CRC64
+	o := types.ParseObject(strings.NewReader(payload[1:len(payload)-10]), payload[0], key)
+	var entries []*entry.Entry
+	for _, cmd := range types.RewriteKey(o, key, ttl, replace) {
+		newEntry := entry.NewEntry()
+		newEntry.DbId = e.DbId
+		newEntry.Argv = cmd
+		newEntry.Parse()
+		entries = append(entries, newEntry)
+	}
+	return entries
+}
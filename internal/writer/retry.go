@@ -0,0 +1,183 @@
+package writer
+
+import (
+	"RedisShake/internal/bidirectional"
+	"RedisShake/internal/client"
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	retryMinBackoff = 100 * time.Millisecond
+	retryMaxBackoff = 5 * time.Second
+)
+
+// retryableErrors are error classes of transient target states. Entries
+// rejected with them are sent again after a backoff, together with the rest
+// of the source transaction they abort.
+var retryableErrors = map[string]bool{
+	"LOADING":     true, // target is loading the dataset after a restart
+	"BUSY":        true, // target is running a slow script or function
+	"OOM":         true, // target reached maxmemory
+	"READONLY":    true, // target became a replica after a failover
+	"TRYAGAIN":    true, // target cluster is resharding
+	"CLUSTERDOWN": true, // target cluster is down
+	"MASTERDOWN":  true, // link with master is down and replica-serve-stale-data is no
+}
+
+func errorClass(err error) string {
+	return strings.SplitN(err.Error(), " ", 2)[0]
+}
+
+func isRetryableError(err error) bool {
+	return retryableErrors[errorClass(err)]
+}
+
+// scheduleRetry queues the entry rejected by a transient error, and pauses
+// sending until the queued entries are sent again after a backoff.
+func (w *redisStandaloneWriter) scheduleRetry(e *entry.Entry, err error) {
+	w.queueRetry(w.withTransaction(e), err, func() {
+		backoff := time.Duration(atomic.LoadInt64(&w.retryBackoff))
+		if backoff == 0 {
+			backoff = retryMinBackoff
+		} else if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+		atomic.StoreInt64(&w.retryBackoff, int64(backoff))
+		reconnect := errorClass(err) == "READONLY"
+		log.Warnf("[%s] target is not available, retry after %v. error=[%v], cmd=[%s]", w.stat.Name, backoff, err, e.String())
+		go w.retry(backoff, reconnect)
+	})
+}
+
+// resendLater queues entries to be sent in place of a rejected entry, and
+// pauses sending until they are sent. Unlike scheduleRetry, they are sent
+// without backoff.
+func (w *redisStandaloneWriter) resendLater(entries []*entry.Entry, err error) {
+	w.queueRetry(entries, err, func() {
+		go w.retry(0, false)
+	})
+}
+
+// withTransaction returns the entries of the source transaction the entry
+// is in, which are replied but discarded by the target, followed by the entry.
+// The entries of the transaction replied after it are queued by
+// queueAbortedTransaction. Called by processReply.
+func (w *redisStandaloneWriter) withTransaction(e *entry.Entry) []*entry.Entry {
+	entries := append([]*entry.Entry(nil), w.repliedTransaction...)
+	w.abortedTransaction = (w.repliedTransaction != nil || e.CmdName == "MULTI") &&
+		e.CmdName != "EXEC" && e.CmdName != "DISCARD"
+	w.repliedTransaction = nil
+	return append(entries, e)
+}
+
+// trackTransaction records the replied entries of the source transaction,
+// called by processReply.
+func (w *redisStandaloneWriter) trackTransaction(e *entry.Entry) {
+	switch {
+	case e.CmdName == "MULTI":
+		w.repliedTransaction = []*entry.Entry{e}
+	case e.CmdName == "EXEC" || e.CmdName == "DISCARD":
+		w.repliedTransaction = nil
+	case w.repliedTransaction != nil:
+		w.repliedTransaction = append(w.repliedTransaction, e)
+	}
+}
+
+// queueAbortedTransaction queues the entry if it is in the source transaction
+// aborted by a retryable error, whatever the reply is, so that the
+// transaction is sent again as a whole. Returns false if the entry is not in
+// such a transaction. Called by processReply.
+func (w *redisStandaloneWriter) queueAbortedTransaction(e *entry.Entry) bool {
+	if !w.abortedTransaction {
+		return false
+	}
+	if e.CmdName == "EXEC" || e.CmdName == "DISCARD" {
+		w.abortedTransaction = false
+	}
+	if _, _, ok := bidirectional.ParseMarker(e.Argv); ok {
+		return true // sent again after MULTI by write
+	}
+	w.retryLock.Lock()
+	defer w.retryLock.Unlock()
+	w.retryEntries = append(w.retryEntries, e)
+	w.stat.RetryingEntries = int64(len(w.retryEntries))
+	w.stat.RetryCount++
+	return true
+}
+
+// queueRetry queues entries and calls schedule if no retry is scheduled.
+func (w *redisStandaloneWriter) queueRetry(entries []*entry.Entry, err error, schedule func()) {
+	w.retryLock.Lock()
+	defer w.retryLock.Unlock()
+	w.retryEntries = append(w.retryEntries, entries...)
+	w.stat.RetryingError = err.Error()
+	w.stat.RetryingEntries = int64(len(w.retryEntries))
+	w.stat.RetryCount += int64(len(entries))
+	if w.retryScheduled {
+		return
+	}
+	w.retryScheduled = true
+	atomic.StoreInt32(&w.paused, 1)
+	schedule()
+}
+
+func (w *redisStandaloneWriter) retry(backoff time.Duration, reconnect bool) {
+	time.Sleep(backoff)
+	w.sendLock.Lock()
+	defer w.sendLock.Unlock()
+
+	// wait for the replies of the entries sent before the pause, the entries
+	// of an aborted transaction among them are queued to be sent again
+	w.waitNoInflight()
+	// the transaction not executed yet is discarded below, it is sent again
+	// from its MULTI after the queued entries
+	transaction := w.repliedTransaction
+	w.repliedTransaction = nil
+	w.abortedTransaction = false
+	if reconnect {
+		// reconnect to find the new master behind the address, e.g. a proxy or a domain name
+		w.client.Close()
+		w.client = client.NewRedisClientWithProtocol(w.opts.Address, w.opts.Username, w.opts.Password, w.opts.Tls, w.opts.Protocol)
+		w.loadedScripts = make(map[string]bool)
+		w.inTransaction = false
+		log.Infof("[%s] reconnected to target.", w.stat.Name)
+	} else if w.inTransaction {
+		// the transaction is sent again from its MULTI
+		w.client.Send("DISCARD")
+		w.inTransaction = false
+		w.enqueue(&entry.Entry{Argv: []string{"discard"}, CmdName: "discard"})
+	}
+	w.DbId = -1 // select db again, the SELECT command may be rejected too
+
+	w.retryLock.Lock()
+	entries := append(w.retryEntries, transaction...)
+	w.retryEntries = nil
+	w.stat.RetryCount += int64(len(transaction))
+	w.retryScheduled = false
+	w.stat.RetryingEntries = 0
+	w.retryLock.Unlock()
+
+	log.Infof("[%s] send %d entries again.", w.stat.Name, len(entries))
+	for _, e := range entries {
+		w.write(e)
+	}
+
+	w.retryLock.Lock()
+	if !w.retryScheduled {
+		w.stat.RetryingError = ""
+		atomic.StoreInt32(&w.paused, 0)
+		w.resumeCond.Broadcast()
+		w.retryCond.Broadcast()
+	}
+	w.retryLock.Unlock()
+}
+
+func (w *redisStandaloneWriter) isRetrying() bool {
+	w.retryLock.Lock()
+	defer w.retryLock.Unlock()
+	return w.retryScheduled
+}
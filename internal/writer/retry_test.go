@@ -0,0 +1,60 @@
+package writer
+
+import (
+	"errors"
+	"testing"
+)
+
+func checkRetryEntries(t *testing.T, w *redisStandaloneWriter, want []string) {
+	t.Helper()
+	if len(w.retryEntries) != len(want) {
+		t.Fatalf("retry entries = %d, want %d", len(w.retryEntries), len(want))
+	}
+	for i, e := range w.retryEntries {
+		if e.CmdName != want[i] {
+			t.Fatalf("retry entry %d is %s, want %s", i, e.CmdName, want[i])
+		}
+	}
+}
+
+func TestRetryInOrder(t *testing.T) {
+	w := new(redisStandaloneWriter)
+	multi, set := newParsedEntry("MULTI"), newParsedEntry("SET", "k", "v")
+	w.trackTransaction(multi)
+	w.trackTransaction(set)
+
+	// the rejected command is sent again with its transaction, but not the
+	// commands replied after the transaction
+	failed, exec, del := newParsedEntry("INCR", "n"), newParsedEntry("EXEC"), newParsedEntry("DEL", "k")
+	if w.queueAbortedTransaction(failed) {
+		t.Fatalf("entry is queued before any retry")
+	}
+	w.queueRetry(w.withTransaction(failed), errors.New("OOM command not allowed"), func() {})
+	if !w.queueAbortedTransaction(exec) {
+		t.Fatalf("the rest of the aborted transaction is not queued")
+	}
+	if w.queueAbortedTransaction(del) {
+		t.Fatalf("entry replied with success is queued")
+	}
+	checkRetryEntries(t, w, []string{"MULTI", "SET", "INCR", "EXEC"})
+
+	// only the rejected command is sent again outside of a transaction
+	w = new(redisStandaloneWriter)
+	w.queueRetry(w.withTransaction(failed), errors.New("OOM command not allowed"), func() {})
+	if w.queueAbortedTransaction(del) {
+		t.Fatalf("entry replied with success is queued")
+	}
+	checkRetryEntries(t, w, []string{"INCR"})
+}
+
+func TestResendRestore(t *testing.T) {
+	w := new(redisStandaloneWriter)
+	w.translator = newCommandTranslator("7.0.0", "panic")
+	// RESTORE k 0 <string "v" of RDB version 11>
+	restore := newParsedEntry("RESTORE", "k", "0", "\x00\x01v\x0b\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	w.queueRetry(w.translator.rewriteRestore(restore), errors.New(restorePayloadError), func() {})
+	if w.queueAbortedTransaction(newParsedEntry("DEL", "k")) {
+		t.Fatalf("entry replied with success is queued")
+	}
+	checkRetryEntries(t, w, []string{"SET"})
+}
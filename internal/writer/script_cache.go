@@ -0,0 +1,83 @@
+package writer
+
+import (
+	"RedisShake/internal/entry"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// scriptCache holds the lua scripts seen in SCRIPT LOAD, EVAL and the RDB
+// lua aux field, so that EVALSHA can be applied to the target nodes that
+// never saw the script. It is shared by all the writers.
+type scriptCache struct {
+	lock    sync.RWMutex
+	scripts map[string]string // sha1 -> body
+}
+
+var scripts = &scriptCache{scripts: make(map[string]string)}
+
+func (c *scriptCache) add(body string) string {
+	sum := sha1.Sum([]byte(body))
+	sha := hex.EncodeToString(sum[:])
+	c.lock.Lock()
+	c.scripts[sha] = body
+	c.lock.Unlock()
+	return sha
+}
+
+func (c *scriptCache) get(sha string) (string, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	body, ok := c.scripts[strings.ToLower(sha)]
+	return body, ok
+}
+
+func newScriptLoadEntry(dbId int, body string) *entry.Entry {
+	e := entry.NewEntry()
+	e.DbId = dbId
+	e.Argv = []string{"SCRIPT", "LOAD", body}
+	e.Parse()
+	return e
+}
+
+// prepareScript records the scripts sent to the target, and loads the script
+// before EVALSHA if it is known but not sent on this connection yet.
+func (w *redisStandaloneWriter) prepareScript(e *entry.Entry) {
+	switch e.CmdName {
+	case "SCRIPT-LOAD":
+		if len(e.Argv) == 3 {
+			w.loadedScripts[scripts.add(e.Argv[2])] = true
+		}
+	case "EVAL", "EVAL_RO":
+		if len(e.Argv) > 2 {
+			w.loadedScripts[scripts.add(e.Argv[1])] = true
+		}
+	case "EVALSHA", "EVALSHA_RO":
+		if len(e.Argv) < 2 {
+			return
+		}
+		sha := strings.ToLower(e.Argv[1])
+		if w.loadedScripts[sha] {
+			return
+		}
+		if body, ok := scripts.get(sha); ok {
+			w.write(newScriptLoadEntry(e.DbId, body))
+		}
+	}
+}
+
+// reloadScript sends the script again followed by the EVALSHA rejected with
+// NOSCRIPT. Returns false if the script is unknown.
+func (w *redisStandaloneWriter) reloadScript(e *entry.Entry, err error) bool {
+	if (e.CmdName != "EVALSHA" && e.CmdName != "EVALSHA_RO") || len(e.Argv) < 2 {
+		return false
+	}
+	body, ok := scripts.get(e.Argv[1])
+	if !ok {
+		return false
+	}
+	w.resendLater([]*entry.Entry{newScriptLoadEntry(e.DbId, body), e}, err)
+	return true
+}
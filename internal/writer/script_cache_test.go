@@ -0,0 +1,27 @@
+package writer
+
+import (
+	"testing"
+)
+
+func TestPrepareScript(t *testing.T) {
+	w := &redisStandaloneWriter{loadedScripts: make(map[string]bool)}
+	w.prepareScript(newParsedEntry("script", "load", "return 1"))
+	w.prepareScript(newParsedEntry("EVAL", "return 2", "0"))
+
+	for sha, body := range map[string]string{
+		"e0e1f9fabfc9d4800c877a703b823ac0578ff8db": "return 1",
+		"7f923f79fe76194c868d7e1d0820de36700eb649": "return 2",
+	} {
+		if !w.loadedScripts[sha] {
+			t.Errorf("script is not recorded as loaded. sha=[%s]", sha)
+		}
+		if ret, ok := scripts.get(sha); !ok || ret != body {
+			t.Errorf("script is not cached. sha=[%s]", sha)
+		}
+	}
+	// sha1 in EVALSHA is case insensitive
+	if _, ok := scripts.get("E0E1F9FABFC9D4800C877A703B823AC0578FF8DB"); !ok {
+		t.Errorf("script is not cached with upper case sha")
+	}
+}
@@ -0,0 +1,389 @@
+package writer
+
+import (
+	"RedisShake/internal/deadletter"
+	"RedisShake/internal/entry"
+	"RedisShake/internal/log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Redis versions are encoded like target_mbbloom_version, v6.2.7 <=> 60207.
+const (
+	redisVersion60 = 60000
+	redisVersion62 = 60200
+	redisVersion70 = 70000
+)
+
+// setScript applies SET with PXAT or KEEPTTL for targets older than 6.2 or 6.0.
+// ARGV: value, PXAT or KEEPTTL, unix time in milliseconds, NX or XX.
+const setScript = `local ttl = -1
+if ARGV[2] == 'KEEPTTL' then ttl = redis.call('PTTL', KEYS[1]) end
+local r = redis.call('SET', KEYS[1], ARGV[1], unpack(ARGV, 4))
+if not r then return r end
+if ARGV[2] == 'PXAT' then redis.call('PEXPIREAT', KEYS[1], ARGV[3])
+elseif ttl > 0 then redis.call('PEXPIRE', KEYS[1], ttl) end
+return r`
+
+// expireScript applies EXPIRE family with NX, XX, GT or LT for targets older than 7.0.
+// ARGV: time, milliseconds per unit, 1 if time is absolute, conditions...
+const expireScript = `redis.replicate_commands()
+local pttl = redis.call('PTTL', KEYS[1])
+if pttl == -2 then return 0 end
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local at = tonumber(ARGV[1]) * tonumber(ARGV[2])
+if ARGV[3] == '0' then at = now + at end
+for i = 4, #ARGV do
+  local cond = string.upper(ARGV[i])
+  if cond == 'NX' and pttl ~= -1 then return 0 end
+  if cond == 'XX' and pttl == -1 then return 0 end
+  if cond == 'GT' and (pttl == -1 or at <= now + pttl) then return 0 end
+  if cond == 'LT' and pttl ~= -1 and at >= now + pttl then return 0 end
+end
+return redis.call('PEXPIREAT', KEYS[1], at)`
+
+// lmpopScript applies LMPOP for targets older than 7.0.
+// ARGV: LEFT or RIGHT, count.
+const lmpopScript = `local pop = 'RPOP'
+if string.upper(ARGV[1]) == 'LEFT' then pop = 'LPOP' end
+for _, key in ipairs(KEYS) do
+  local n = redis.call('LLEN', key)
+  if n > 0 then
+    local items = {}
+    for i = 1, math.min(n, tonumber(ARGV[2])) do items[i] = redis.call(pop, key) end
+    return {key, items}
+  end
+end
+return false`
+
+// copyScript applies COPY without DB option for targets older than 6.2.
+// ARGV: 1 if REPLACE.
+const copyScript = `redis.replicate_commands()
+local v = redis.call('DUMP', KEYS[1])
+if not v then return 0 end
+if ARGV[1] ~= '1' and redis.call('EXISTS', KEYS[2]) == 1 then return 0 end
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then ttl = 0 end
+redis.call('DEL', KEYS[2])
+redis.call('RESTORE', KEYS[2], ttl, v)
+return 1`
+
+// streamAutoSeqRegex matches stream ids with an auto generated sequence, e.g. "1526919030474-*".
+var streamAutoSeqRegex = regexp.MustCompile(`^\d+-\*$`)
+
+// commandTranslator translates the commands a target of an older version does
+// not know into equivalent commands or lua scripts, and rejects the ones that
+// can not be translated.
+type commandTranslator struct {
+	version  int
+	behavior string
+
+	restoreRewrite int32 // 1 if the target can not load DUMP payloads
+}
+
+func newCommandTranslator(version string, behavior string) *commandTranslator {
+	deadletter.CheckBehavior("unsupported_command_behavior", behavior)
+	t := new(commandTranslator)
+	t.version = parseVersion(version)
+	t.behavior = behavior
+	if t.version == 0 {
+		log.Warnf("unknown target version [%s], commands will not be translated", version)
+	}
+	return t
+}
+
+// parseVersion parses "6.2.7" into 60207. Returns 0 if version is invalid.
+func parseVersion(version string) int {
+	items := strings.Split(version, ".")
+	if len(items) < 2 {
+		return 0
+	}
+	ret := 0
+	for i := 0; i < 3; i++ {
+		num := 0
+		if i < len(items) {
+			var err error
+			num, err = strconv.Atoi(items[i])
+			if err != nil {
+				return 0
+			}
+		}
+		ret = ret*100 + num
+	}
+	return ret
+}
+
+func (t *commandTranslator) reject(e *entry.Entry, reason string) []*entry.Entry {
+	deadletter.Reject(t.behavior, e, reason)
+	return nil
+}
+
+// unsupportedErrors are replied by targets that do not know the command or
+// some of its options. Generic errors like "syntax error" are not included,
+// they are replied for invalid arguments of known commands too.
+var unsupportedErrors = []string{"unknown command", "unknown subcommand", "unrecognized option", "unknown option", "unsupported option"}
+
+// isUnsupportedError returns true if err is replied by a target older than
+// 7.0 because it does not know the command or its options, e.g. FUNCTION on
+// 6.x. These errors are handled by unsupported_command_behavior.
+func (t *commandTranslator) isUnsupportedError(err error) bool {
+	if !t.needTranslate(redisVersion70) {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range unsupportedErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *commandTranslator) needTranslate(since int) bool {
+	return t.version != 0 && t.version < since
+}
+
+// translate returns the entries to write instead of e, which may be empty if
+// the command has no effect on the target or is rejected.
+func (t *commandTranslator) translate(e *entry.Entry) []*entry.Entry {
+	if e.CmdName == "RESTORE" && atomic.LoadInt32(&t.restoreRewrite) == 1 {
+		return t.rewriteRestore(e)
+	}
+	if !t.needTranslate(redisVersion70) {
+		return []*entry.Entry{e}
+	}
+	switch e.CmdName {
+	case "GETEX":
+		if t.needTranslate(redisVersion62) {
+			return t.translateGetEx(e)
+		}
+	case "SET":
+		return t.translateSet(e)
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		if len(e.Argv) > 3 {
+			return t.translateExpire(e)
+		}
+	case "LMPOP", "BLMPOP":
+		return t.translateLmpop(e)
+	case "COPY":
+		if t.needTranslate(redisVersion62) {
+			return t.translateCopy(e)
+		}
+	case "XADD", "XTRIM":
+		return t.translateStream(e)
+	case "FUNCTION", "FCALL", "FCALL_RO":
+		return t.reject(e, "functions are not supported by target older than 7.0")
+	}
+	return []*entry.Entry{e}
+}
+
+func newEvalEntry(e *entry.Entry, script string, keys []string, args ...string) *entry.Entry {
+	newEntry := entry.NewEntry()
+	newEntry.DbId = e.DbId
+	newEntry.Argv = append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+	newEntry.Argv = append(newEntry.Argv, args...)
+	newEntry.Parse()
+	return newEntry
+}
+
+// translateGetEx turns "GETEX key [EX|PX|EXAT|PXAT time | PERSIST]" into the
+// corresponding EXPIRE family command or PERSIST.
+func (t *commandTranslator) translateGetEx(e *entry.Entry) []*entry.Entry {
+	if len(e.Argv) == 2 {
+		return nil // GETEX without options is a read command
+	}
+	newEntry := entry.NewEntry()
+	newEntry.DbId = e.DbId
+	option := strings.ToUpper(e.Argv[2])
+	switch {
+	case option == "PERSIST" && len(e.Argv) == 3:
+		newEntry.Argv = []string{"PERSIST", e.Argv[1]}
+	case len(e.Argv) == 4 && (option == "EX" || option == "PX" || option == "EXAT" || option == "PXAT"):
+		cmd := map[string]string{"EX": "EXPIRE", "PX": "PEXPIRE", "EXAT": "EXPIREAT", "PXAT": "PEXPIREAT"}[option]
+		newEntry.Argv = []string{cmd, e.Argv[1], e.Argv[3]}
+	default:
+		return t.reject(e, "invalid GETEX command")
+	}
+	newEntry.Parse()
+	return []*entry.Entry{newEntry}
+}
+
+// translateSet drops the GET option, and applies EXAT, PXAT and KEEPTTL with
+// a lua script for the targets that do not support them.
+func (t *commandTranslator) translateSet(e *entry.Entry) []*entry.Entry {
+	if len(e.Argv) < 3 {
+		return []*entry.Entry{e}
+	}
+	argv := []string{e.Argv[0], e.Argv[1], e.Argv[2]}
+	var conditions []string
+	mode, pxat := "", ""
+	changed := false
+	for i := 3; i < len(e.Argv); i++ {
+		option := strings.ToUpper(e.Argv[i])
+		switch option {
+		case "GET":
+			if t.needTranslate(redisVersion62) {
+				changed = true
+				continue
+			}
+		case "NX", "XX":
+			conditions = append(conditions, option)
+		case "EXAT", "PXAT":
+			if i+1 >= len(e.Argv) {
+				return t.reject(e, "invalid SET command")
+			}
+			if t.needTranslate(redisVersion62) {
+				at, err := strconv.ParseInt(e.Argv[i+1], 10, 64)
+				if err != nil {
+					return t.reject(e, "invalid SET command")
+				}
+				if option == "EXAT" {
+					at *= 1000
+				}
+				mode, pxat = "PXAT", strconv.FormatInt(at, 10)
+				i++
+				continue
+			}
+		case "KEEPTTL":
+			if t.needTranslate(redisVersion60) {
+				mode = "KEEPTTL"
+				continue
+			}
+		}
+		argv = append(argv, e.Argv[i])
+	}
+	if mode != "" {
+		args := append([]string{e.Argv[2], mode, pxat}, conditions...)
+		return []*entry.Entry{newEvalEntry(e, setScript, []string{e.Argv[1]}, args...)}
+	}
+	if changed {
+		e.Argv = argv
+		e.Parse()
+	}
+	return []*entry.Entry{e}
+}
+
+// translateExpire applies "EXPIRE key time NX|XX|GT|LT" and its variants with a lua script.
+func (t *commandTranslator) translateExpire(e *entry.Entry) []*entry.Entry {
+	unit, absolute := "1000", "0"
+	switch e.CmdName {
+	case "PEXPIRE":
+		unit = "1"
+	case "EXPIREAT":
+		absolute = "1"
+	case "PEXPIREAT":
+		unit, absolute = "1", "1"
+	}
+	for _, option := range e.Argv[3:] {
+		switch strings.ToUpper(option) {
+		case "NX", "XX", "GT", "LT":
+		default:
+			return t.reject(e, "invalid "+e.CmdName+" command")
+		}
+	}
+	args := append([]string{e.Argv[2], unit, absolute}, e.Argv[3:]...)
+	return []*entry.Entry{newEvalEntry(e, expireScript, []string{e.Argv[1]}, args...)}
+}
+
+// translateLmpop applies "[B]LMPOP [timeout] numkeys key [key ...] LEFT|RIGHT [COUNT count]"
+// with a lua script.
+func (t *commandTranslator) translateLmpop(e *entry.Entry) []*entry.Entry {
+	argv := e.Argv[1:]
+	if e.CmdName == "BLMPOP" && len(argv) > 0 {
+		argv = argv[1:] // blocking is meaningless when replicating
+	}
+	if len(argv) < 3 {
+		return t.reject(e, "invalid "+e.CmdName+" command")
+	}
+	numKeys, err := strconv.Atoi(argv[0])
+	if err != nil || numKeys <= 0 || len(argv) < numKeys+2 {
+		return t.reject(e, "invalid "+e.CmdName+" command")
+	}
+	keys := argv[1 : numKeys+1]
+	direction := argv[numKeys+1]
+	count := "1"
+	rest := argv[numKeys+2:]
+	if len(rest) == 2 && strings.EqualFold(rest[0], "COUNT") {
+		count = rest[1]
+	} else if len(rest) != 0 {
+		return t.reject(e, "invalid "+e.CmdName+" command")
+	}
+	return []*entry.Entry{newEvalEntry(e, lmpopScript, keys, direction, count)}
+}
+
+// translateCopy applies "COPY source destination [REPLACE]" with a lua script.
+func (t *commandTranslator) translateCopy(e *entry.Entry) []*entry.Entry {
+	if len(e.Argv) < 3 {
+		return t.reject(e, "invalid COPY command")
+	}
+	replace := "0"
+	for _, option := range e.Argv[3:] {
+		switch strings.ToUpper(option) {
+		case "REPLACE":
+			replace = "1"
+		case "DB":
+			return t.reject(e, "COPY with DB option is not supported by target older than 6.2")
+		default:
+			return t.reject(e, "invalid COPY command")
+		}
+	}
+	return []*entry.Entry{newEvalEntry(e, copyScript, []string{e.Argv[1], e.Argv[2]}, replace)}
+}
+
+// translateStream drops the XADD and XTRIM options that are not supported by
+// the target and do not change the result of replication: NOMKSTREAM, LIMIT
+// and the exact trimming operator "=". MINID and ids with an auto generated
+// sequence are rejected.
+func (t *commandTranslator) translateStream(e *entry.Entry) []*entry.Entry {
+	if len(e.Argv) < 3 {
+		return []*entry.Entry{e}
+	}
+	before62 := t.needTranslate(redisVersion62)
+	argv := []string{e.Argv[0], e.Argv[1]}
+	i := 2
+	for ; i < len(e.Argv); i++ {
+		option := strings.ToUpper(e.Argv[i])
+		if option == "NOMKSTREAM" && e.CmdName == "XADD" {
+			if !before62 {
+				argv = append(argv, e.Argv[i])
+			}
+			continue
+		}
+		if option != "MAXLEN" && option != "MINID" {
+			break
+		}
+		if option == "MINID" && before62 {
+			return t.reject(e, "MINID is not supported by target older than 6.2")
+		}
+		argv = append(argv, e.Argv[i])
+		if i+1 < len(e.Argv) && (e.Argv[i+1] == "=" || e.Argv[i+1] == "~") {
+			if e.Argv[i+1] == "~" || !before62 {
+				argv = append(argv, e.Argv[i+1])
+			}
+			i++
+		}
+		if i+1 >= len(e.Argv) {
+			return t.reject(e, "invalid "+e.CmdName+" command")
+		}
+		argv = append(argv, e.Argv[i+1])
+		i++
+		if i+2 < len(e.Argv) && strings.EqualFold(e.Argv[i+1], "LIMIT") {
+			if !before62 {
+				argv = append(argv, e.Argv[i+1], e.Argv[i+2])
+			}
+			i += 2
+		}
+	}
+	if e.CmdName == "XADD" && i < len(e.Argv) && streamAutoSeqRegex.MatchString(e.Argv[i]) {
+		return t.reject(e, "stream id with auto generated sequence is not supported by target older than 7.0")
+	}
+	argv = append(argv, e.Argv[i:]...)
+	if len(argv) != len(e.Argv) {
+		e.Argv = argv
+		e.Parse()
+	}
+	return []*entry.Entry{e}
+}
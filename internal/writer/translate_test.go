@@ -0,0 +1,74 @@
+package writer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	cases := map[string]int{"6.2.7": 60207, "7.0": 70000, "5.0.14": 50014, "": 0, "unknown": 0}
+	for version, expected := range cases {
+		if ret := parseVersion(version); ret != expected {
+			t.Errorf("parseVersion(%s) failed. expected=%d, ret=%d", version, expected, ret)
+		}
+	}
+}
+
+func TestCommandTranslator(t *testing.T) {
+	translator := newCommandTranslator("5.0.14", "skip")
+	cases := map[string]string{
+		"GETEX k PX 100":                              "PEXPIRE k 100",
+		"GETEX k PERSIST":                             "PERSIST k",
+		"SET k v NX GET EX 10":                        "SET k v NX EX 10",
+		"XADD s NOMKSTREAM MAXLEN = 10 LIMIT 5 * f v": "XADD s MAXLEN 10 * f v",
+		"XTRIM s MAXLEN ~ 10 LIMIT 5":                 "XTRIM s MAXLEN ~ 10",
+		"DEL k":                                       "DEL k",
+	}
+	for command, expected := range cases {
+		entries := translator.translate(newParsedEntry(strings.Split(command, " ")...))
+		if len(entries) != 1 || strings.Join(entries[0].Argv, " ") != expected {
+			t.Errorf("translate(%s) failed. entries=%v", command, entries)
+		}
+	}
+
+	// read only
+	if entries := translator.translate(newParsedEntry("GETEX", "k")); len(entries) != 0 {
+		t.Errorf("translate(GETEX k) failed. entries=%v", entries)
+	}
+
+	// lua scripts keep the keys
+	for _, command := range []string{"SET k v PXAT 100", "SET k v KEEPTTL", "EXPIRE k 10 NX", "COPY k k2 REPLACE", "LMPOP 2 k k2 LEFT COUNT 2"} {
+		entries := translator.translate(newParsedEntry(strings.Split(command, " ")...))
+		if len(entries) != 1 || entries[0].CmdName != "EVAL" || entries[0].Keys[0] != "k" {
+			t.Errorf("translate(%s) failed. entries=%v", command, entries)
+		}
+	}
+
+	// targets of the latest version do not need translation
+	translator = newCommandTranslator("7.2.4", "skip")
+	if entries := translator.translate(newParsedEntry("GETEX", "k", "PX", "100")); len(entries) != 1 || entries[0].CmdName != "GETEX" {
+		t.Errorf("translate(GETEX) failed for 7.2. entries=%v", entries)
+	}
+}
+
+func TestIsUnsupportedError(t *testing.T) {
+	cases := []struct {
+		version string
+		err     string
+		want    bool
+	}{
+		{"6.2.7", "ERR unknown command 'FUNCTION', with args beginning with: 'LOAD' ", true},
+		{"6.2.7", "ERR unknown subcommand 'NO-EVICT'. Try CLIENT HELP.", true},
+		{"6.2.7", "ERR Unrecognized option 'X'", true},
+		{"6.2.7", "ERR syntax error", false},
+		{"6.2.7", "ERR wrong number of arguments for 'set' command", false},
+		{"6.2.7", "WRONGTYPE Operation against a key holding the wrong kind of value", false},
+		{"7.2.0", "ERR unknown command 'FOO'", false},
+	}
+	for _, c := range cases {
+		if got := newCommandTranslator(c.version, "skip").isUnsupportedError(errors.New(c.err)); got != c.want {
+			t.Errorf("isUnsupportedError(%s, %q) = %v, want %v", c.version, c.err, got, c.want)
+		}
+	}
+}